@@ -0,0 +1,28 @@
+//go:build !race
+
+package tinyrebuilder_test
+
+import "testing"
+
+// The race detector makes sync.Pool drop items at random, so allocations
+// are only counted without it.
+
+func TestFindSubmatchIndexIntoAllocations(t *testing.T) {
+	re := keyValueBuilder().MustCompile()
+	dst := make([]int, 0, 2*(re.NumSubexp()+1))
+	dst = re.FindSubmatchIndexInto(dst, keyValueInput)
+	if allocs := testing.AllocsPerRun(100, func() {
+		dst = re.FindSubmatchIndexInto(dst, keyValueInput)
+	}); allocs != 0 {
+		t.Errorf("FindSubmatchIndexInto allocated %v times per run; want 0", allocs)
+	}
+	m := re.NewMatcher()
+	if allocs := testing.AllocsPerRun(100, func() {
+		_ = m.FindSubmatchIndex(keyValueInput)
+	}); allocs != 0 {
+		t.Errorf("Matcher.FindSubmatchIndex allocated %v times per run; want 0", allocs)
+	}
+	if got := keyValueInput[dst[4]:dst[5]]; got != "12345" {
+		t.Errorf("Expected value group to capture '12345', got %q", got)
+	}
+}
@@ -0,0 +1,214 @@
+package tinyrebuilder
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// CacheKey identifies a compilation in a Cache: a pattern and the options it
+// was compiled with. CacheKeys are comparable, so they can key a map.
+type CacheKey struct {
+	Pattern string
+	Options Options
+}
+
+// Cache stores the compiled patterns of a Compiler. Implementations must be
+// safe for concurrent use. A Cache that also has a method
+//
+//	Keys() []CacheKey
+//
+// returning its keys from most to least recently used can be written out
+// by DumpManifest. All the backends of this package have one.
+type Cache interface {
+	// Get returns the Regexp stored under key, if any.
+	Get(key CacheKey) (*Regexp, bool)
+	// Add stores re under key, evicting other entries if the cache is full.
+	Add(key CacheKey, re *Regexp)
+	// Len returns the number of entries in the cache.
+	Len() int
+}
+
+// CacheFactory creates an empty Cache holding up to size patterns, which
+// must call onEvict, if it is not nil, for every entry it evicts to make room
+// for another. A Compiler calls its factory again whenever it is purged or
+// resized. NewLRUCache, NewARCCache, New2QCache and NewNoopCache are
+// CacheFactories, as are the results of NewCostCache and NewShardedCache.
+type CacheFactory func(size int, onEvict func(CacheKey, *Regexp)) (Cache, error)
+
+// NewLRUCache returns a Cache that evicts the least recently used pattern.
+// It is the default.
+func NewLRUCache(size int, onEvict func(CacheKey, *Regexp)) (Cache, error) {
+	l, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &lruCache{lru: l, size: size, onEvict: onEvict}, nil
+}
+
+type lruCache struct {
+	mu      sync.Mutex
+	lru     *simplelru.LRU
+	size    int
+	onEvict func(CacheKey, *Regexp)
+}
+
+func (c *lruCache) Get(key CacheKey) (*Regexp, bool) {
+	c.mu.Lock()
+	val, ok := c.lru.Get(key)
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return val.(*Regexp), true
+}
+
+func (c *lruCache) Add(key CacheKey, re *Regexp) {
+	c.mu.Lock()
+	var oldKey, oldVal any
+	evicted := false
+	if c.lru.Len() >= c.size && !c.lru.Contains(key) {
+		oldKey, oldVal, evicted = c.lru.RemoveOldest()
+	}
+	c.lru.Add(key, re)
+	c.mu.Unlock()
+	// The callback runs outside the lock, so it may use the cache.
+	if evicted && c.onEvict != nil {
+		c.onEvict(oldKey.(CacheKey), oldVal.(*Regexp))
+	}
+}
+
+func (c *lruCache) Keys() []CacheKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return reverseKeys(c.lru.Keys())
+}
+
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// NewARCCache returns a Cache using the Adaptive Replacement Cache policy,
+// which balances recently and frequently used patterns and so keeps hot
+// patterns while one-off patterns stream through.
+func NewARCCache(size int, onEvict func(CacheKey, *Regexp)) (Cache, error) {
+	arc, err := lru.NewARC(size)
+	if err != nil {
+		return nil, err
+	}
+	return newTrackedCache(arc, onEvict), nil
+}
+
+// New2QCache returns a Cache using the 2Q policy, which admits new patterns
+// to a probationary queue and promotes them only when they are used again.
+func New2QCache(size int, onEvict func(CacheKey, *Regexp)) (Cache, error) {
+	q, err := lru.New2Q(size)
+	if err != nil {
+		return nil, err
+	}
+	return newTrackedCache(q, onEvict), nil
+}
+
+// policyCache is the part of the ARC and 2Q caches of golang-lru that a
+// trackedCache uses.
+type policyCache interface {
+	Get(key any) (any, bool)
+	Add(key, value any)
+	Contains(key any) bool
+	Keys() []any
+	Len() int
+}
+
+// trackedCache reports the evictions of a cache that has no eviction
+// callback of its own. It keeps the entries it has added, and when an
+// addition does not grow the cache, it looks for the entries that are gone.
+// Finding them takes time proportional to the size of the cache, but only
+// when something was evicted.
+type trackedCache struct {
+	mu      sync.Mutex
+	cache   policyCache
+	entries map[CacheKey]*Regexp
+	onEvict func(CacheKey, *Regexp)
+}
+
+func newTrackedCache(cache policyCache, onEvict func(CacheKey, *Regexp)) *trackedCache {
+	return &trackedCache{cache: cache, entries: make(map[CacheKey]*Regexp), onEvict: onEvict}
+}
+
+func (c *trackedCache) Get(key CacheKey) (*Regexp, bool) {
+	c.mu.Lock()
+	val, ok := c.cache.Get(key)
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return val.(*Regexp), true
+}
+
+func (c *trackedCache) Add(key CacheKey, re *Regexp) {
+	c.mu.Lock()
+	before := c.cache.Len()
+	_, present := c.entries[key]
+	c.cache.Add(key, re)
+	c.entries[key] = re
+	var evicted []CacheKey
+	if !present && c.cache.Len() <= before {
+		for k := range c.entries {
+			if !c.cache.Contains(k) {
+				evicted = append(evicted, k)
+			}
+		}
+	}
+	gone := make([]*Regexp, len(evicted))
+	for i, k := range evicted {
+		gone[i] = c.entries[k]
+		delete(c.entries, k)
+	}
+	c.mu.Unlock()
+	if c.onEvict != nil {
+		for i, k := range evicted {
+			c.onEvict(k, gone[i])
+		}
+	}
+}
+
+// Keys lists the frequently used patterns before the recently used ones, as
+// the policies of ARC and 2Q rank them.
+func (c *trackedCache) Keys() []CacheKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return reverseKeys(c.cache.Keys())
+}
+
+func (c *trackedCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache.Len()
+}
+
+// reverseKeys converts keys listed from least to most recently used, as
+// golang-lru lists them, to CacheKeys listed the other way round.
+func reverseKeys(keys []any) []CacheKey {
+	out := make([]CacheKey, len(keys))
+	for i, k := range keys {
+		out[len(keys)-1-i] = k.(CacheKey)
+	}
+	return out
+}
+
+// NewNoopCache returns a Cache that stores nothing, so that every
+// compilation runs afresh. Concurrent compilations of the same pattern are
+// still shared.
+func NewNoopCache(int, func(CacheKey, *Regexp)) (Cache, error) {
+	return noopCache{}, nil
+}
+
+type noopCache struct{}
+
+func (noopCache) Get(CacheKey) (*Regexp, bool) { return nil, false }
+func (noopCache) Add(CacheKey, *Regexp)        {}
+func (noopCache) Len() int                     { return 0 }
+func (noopCache) Keys() []CacheKey             { return nil }
@@ -0,0 +1,179 @@
+package tinyrebuilder
+
+import (
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// The backtracker is used instead of the Pike VM of the machine for small
+// programs on short inputs, where following one thread at a time and
+// recording each visited (instruction, position) pair is cheaper than
+// advancing every thread in lockstep. As in the standard library, the
+// visited set bounds the work to the size of the set.
+const (
+	maxBacktrackProg   = 500
+	maxBacktrackVector = 256 * 1024
+)
+
+// backtrackJob is a point at which the backtracker resumes after a thread
+// fails. For a capture instruction with arg set, pos holds the capture
+// index to restore instead of a position.
+type backtrackJob struct {
+	pc  uint32
+	arg bool
+	pos int
+}
+
+// canBacktrack reports whether m can search s with the backtracker, which
+// finds leftmost-first matches only.
+func (m *machine) canBacktrack(s string) bool {
+	n := len(m.p.prog.Inst)
+	return !m.longest && m.mustEnd < 0 && n <= maxBacktrackProg && n*(len(s)+1) <= maxBacktrackVector
+}
+
+// backtrack is like match, searching s for a leftmost-first match beginning
+// at or after pos with the backtracker. The caller checks canBacktrack.
+func (m *machine) backtrack(s string, pos int) bool {
+	startCond := m.p.startCond
+	if startCond == ^syntax.EmptyOp(0) || startCond&syntax.EmptyBeginText != 0 && pos != 0 {
+		return false
+	}
+	m.matched, m.err = false, nil
+	for i := range m.matchcap {
+		m.matchcap[i] = -1
+	}
+	// The visited set is not reset between start positions: a pair that
+	// failed from one start fails from any later one.
+	words := (len(m.p.prog.Inst)*(len(s)+1) + 31) / 32
+	if cap(m.visited) < words {
+		m.visited = make([]uint32, words)
+	} else {
+		m.visited = m.visited[:words]
+		clear(m.visited)
+	}
+	if cap(m.btcap) < len(m.matchcap) {
+		m.btcap = make([]int, len(m.matchcap))
+	}
+	m.btcap = m.btcap[:len(m.matchcap)]
+	// A failed attempt restores every capture it set, so the indices need
+	// resetting only once.
+	for i := range m.btcap {
+		m.btcap[i] = -1
+	}
+	for {
+		if len(m.btcap) > 0 {
+			m.btcap[0] = pos
+		}
+		if m.tryBacktrack(s, uint32(m.p.prog.Start), pos) {
+			m.matched = true
+			return true
+		}
+		if startCond&syntax.EmptyBeginText != 0 {
+			return false
+		}
+		_, width := m.runeAt(s, pos)
+		if width == 0 {
+			return false
+		}
+		pos += width
+	}
+}
+
+// shouldVisit marks the pair (pc, pos) as visited, reporting whether it was
+// not already.
+func (m *machine) shouldVisit(s string, pc uint32, pos int) bool {
+	n := uint(pc)*uint(len(s)+1) + uint(pos)
+	if m.visited[n/32]&(1<<(n&31)) != 0 {
+		return false
+	}
+	m.visited[n/32] |= 1 << (n & 31)
+	return true
+}
+
+func (m *machine) push(s string, insts []syntax.Inst, pc uint32, pos int, arg bool) {
+	if insts[pc].Op != syntax.InstFail && (arg || m.shouldVisit(s, pc, pos)) {
+		m.jobs = append(m.jobs, backtrackJob{pc: pc, arg: arg, pos: pos})
+	}
+}
+
+// tryBacktrack runs the program from pc at pos, leaving the submatch indices
+// of the first match found in m.matchcap.
+func (m *machine) tryBacktrack(s string, pc uint32, pos int) bool {
+	insts := m.p.prog.Inst
+	m.jobs = m.jobs[:0]
+	m.push(s, insts, pc, pos, false)
+	for len(m.jobs) > 0 {
+		l := len(m.jobs) - 1
+		job := m.jobs[l]
+		m.jobs = m.jobs[:l]
+		pc, pos, arg := job.pc, job.pos, job.arg
+		// A popped job was marked visited when it was pushed.
+		for visit := false; ; visit = true {
+			if visit && !m.shouldVisit(s, pc, pos) {
+				break
+			}
+			inst := &insts[pc]
+			next := true
+			switch inst.Op {
+			case syntax.InstFail:
+				next = false
+			case syntax.InstAlt, syntax.InstAltMatch:
+				if arg {
+					// The preferred branch failed; try the other.
+					arg = false
+					pc = inst.Arg
+				} else {
+					m.push(s, insts, pc, pos, true)
+					pc = inst.Out
+				}
+			case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+				r, width := endOfText, 0
+				if pos < len(s) && s[pos] < utf8.RuneSelf {
+					r, width = rune(s[pos]), 1
+				} else {
+					r, width = m.runeAt(s, pos)
+				}
+				switch inst.Op {
+				case syntax.InstRune:
+					next = inst.MatchRune(r)
+				case syntax.InstRune1:
+					next = r == inst.Rune[0]
+				case syntax.InstRuneAny:
+					next = r != endOfText
+				default:
+					next = r != endOfText && r != '\n'
+				}
+				pos += width
+				pc = inst.Out
+			case syntax.InstCapture:
+				if arg {
+					// Restore the index the capture overwrote.
+					m.btcap[inst.Arg] = pos
+					next = false
+				} else {
+					if int(inst.Arg) < len(m.btcap) {
+						m.push(s, insts, pc, m.btcap[inst.Arg], true)
+						m.btcap[inst.Arg] = pos
+					}
+					pc = inst.Out
+				}
+			case syntax.InstEmptyWidth:
+				r, _ := m.runeAt(s, pos)
+				next = syntax.EmptyOp(inst.Arg)&^emptyOpContext(m.runeBefore(s, pos), r) == 0
+				pc = inst.Out
+			case syntax.InstNop:
+				pc = inst.Out
+			case syntax.InstMatch:
+				if len(m.btcap) > 1 {
+					m.btcap[1] = pos
+				}
+				copy(m.matchcap, m.btcap)
+				return true
+			}
+			if !next {
+				break
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package tinyrebuilder
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// batchChunk is the number of inputs a worker claims at a time. Claiming
+// inputs in chunks keeps the workers from contending on every record, and
+// cancellation is checked between chunks.
+const batchChunk = 256
+
+// BatchStats summarizes a batch operation.
+type BatchStats struct {
+	// Inputs is the number of inputs examined.
+	Inputs int
+	// Matched is the number of inputs with at least one match.
+	Matched int
+	// PerPattern holds, for a RegexpSet, the number of inputs matched by each
+	// pattern. It is nil for a single Regexp.
+	PerPattern []int
+}
+
+// runBatch calls fn for every index in [0, n) from up to workers goroutines
+// (GOMAXPROCS if workers <= 0) and returns the number of calls that returned
+// true. It stops early with ctx.Err() if ctx is done.
+func runBatch(ctx context.Context, n, workers int, fn func(i int) bool) (int, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, (n+batchChunk-1)/batchChunk)
+	var next, matched atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count := 0
+			for ctx.Err() == nil {
+				start := int(next.Add(batchChunk)) - batchChunk
+				if start >= n {
+					break
+				}
+				for i := start; i < min(start+batchChunk, n); i++ {
+					if fn(i) {
+						count++
+					}
+				}
+			}
+			matched.Add(int64(count))
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return int(matched.Load()), nil
+}
+
+// MatchBatch reports, for each input, whether the Regexp matches it. The
+// inputs are shared among up to workers goroutines (GOMAXPROCS if workers <=
+// 0), and the results are in the order of the inputs.
+func (r *Regexp) MatchBatch(inputs []string, workers int) []bool {
+	out, _, _ := r.MatchBatchContext(context.Background(), inputs, workers)
+	return out
+}
+
+// MatchBatchContext is like MatchBatch, but stops and returns ctx.Err() if
+// ctx is done before every input has been examined. It also reports how many
+// inputs matched.
+func (r *Regexp) MatchBatchContext(ctx context.Context, inputs []string, workers int) ([]bool, BatchStats, error) {
+	out := make([]bool, len(inputs))
+	matched, err := runBatch(ctx, len(inputs), workers, func(i int) bool {
+		out[i] = r.MatchString(inputs[i])
+		return out[i]
+	})
+	if err != nil {
+		return nil, BatchStats{}, err
+	}
+	return out, BatchStats{Inputs: len(inputs), Matched: matched}, nil
+}
+
+// FindBatch returns, for each input, the result of FindStringSubmatch: the
+// text of the leftmost match and of its groups, or nil if there is no match.
+// The work is shared as in MatchBatch, and the results are in the order of
+// the inputs.
+func (r *Regexp) FindBatch(inputs []string, workers int) [][]string {
+	out, _, _ := r.FindBatchContext(context.Background(), inputs, workers)
+	return out
+}
+
+// FindBatchContext is like FindBatch, with the cancellation and statistics of
+// MatchBatchContext.
+func (r *Regexp) FindBatchContext(ctx context.Context, inputs []string, workers int) ([][]string, BatchStats, error) {
+	out := make([][]string, len(inputs))
+	matched, err := runBatch(ctx, len(inputs), workers, func(i int) bool {
+		out[i] = r.FindStringSubmatch(inputs[i])
+		return out[i] != nil
+	})
+	if err != nil {
+		return nil, BatchStats{}, err
+	}
+	return out, BatchStats{Inputs: len(inputs), Matched: matched}, nil
+}
+
+// RegexpSet is a collection of patterns matched against the same inputs.
+// A RegexpSet is safe for concurrent use.
+type RegexpSet struct {
+	res []*Regexp
+}
+
+// NewRegexpSet returns a set of the given patterns. Patterns are identified
+// by their position in the argument list.
+func NewRegexpSet(res ...*Regexp) *RegexpSet {
+	return &RegexpSet{res: append([]*Regexp(nil), res...)}
+}
+
+// Len returns the number of patterns in the set.
+func (s *RegexpSet) Len() int {
+	return len(s.res)
+}
+
+// MatchString returns the indices of the patterns that match str, in
+// increasing order, or nil if none do.
+func (s *RegexpSet) MatchString(str string) []int {
+	var out []int
+	for i, re := range s.res {
+		if re.MatchString(str) {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// MatchBatch returns, for each input, the indices of the patterns that match
+// it, as in MatchString. The work is shared as in Regexp.MatchBatch.
+func (s *RegexpSet) MatchBatch(inputs []string, workers int) [][]int {
+	out, _, _ := s.MatchBatchContext(context.Background(), inputs, workers)
+	return out
+}
+
+// MatchBatchContext is like MatchBatch, but stops and returns ctx.Err() if
+// ctx is done before every input has been examined. The statistics include
+// the number of inputs matched by each pattern.
+func (s *RegexpSet) MatchBatchContext(ctx context.Context, inputs []string, workers int) ([][]int, BatchStats, error) {
+	out := make([][]int, len(inputs))
+	matched, err := runBatch(ctx, len(inputs), workers, func(i int) bool {
+		out[i] = s.MatchString(inputs[i])
+		return out[i] != nil
+	})
+	if err != nil {
+		return nil, BatchStats{}, err
+	}
+	stats := BatchStats{Inputs: len(inputs), Matched: matched, PerPattern: make([]int, len(s.res))}
+	for _, ids := range out {
+		for _, id := range ids {
+			stats.PerPattern[id]++
+		}
+	}
+	return out, stats, nil
+}
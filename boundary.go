@@ -0,0 +1,132 @@
+package tinyrebuilder
+
+import (
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// The standard library's \b and \B only treat ASCII letters, digits and
+// underscores as word characters. Unicode word boundaries are written into
+// the pattern as empty named groups, which the standard library accepts and
+// ignores, and which the Regexp wrapper turns into assertions of its own
+// machine.
+const (
+	markerPrefix              = "(?P<__tinyrebuilder_"
+	unicodeWordBoundaryName   = "__tinyrebuilder_wb"
+	unicodeNoWordBoundaryName = "__tinyrebuilder_nwb"
+
+	unicodeWordBoundaryMarker   = "(?P<" + unicodeWordBoundaryName + ">)"
+	unicodeNoWordBoundaryMarker = "(?P<" + unicodeNoWordBoundaryName + ">)"
+)
+
+// Empty-width conditions beyond those of regexp/syntax, which uses the low
+// six bits of syntax.EmptyOp.
+const (
+	emptyUnicodeWordBoundary   syntax.EmptyOp = 1 << 6
+	emptyUnicodeNoWordBoundary syntax.EmptyOp = 1 << 7
+)
+
+// markerCapBase is the capture number given to boundary markers when a
+// pattern is prepared for the machine, far above any real group. The marker
+// for a non-boundary uses the next number.
+const markerCapBase = 1 << 20
+
+// isUnicodeWordChar reports whether r is a word character for Unicode word
+// boundaries: a letter, digit, combining mark or underscore.
+func isUnicodeWordChar(r rune) bool {
+	if r < 0x80 {
+		return r == '_' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// emptyOpContext is like syntax.EmptyOpContext, but also reports whether the
+// position between r1 and r2 is a Unicode word boundary.
+func emptyOpContext(r1, r2 rune) syntax.EmptyOp {
+	op := syntax.EmptyOpContext(r1, r2)
+	if isUnicodeWordChar(r1) != isUnicodeWordChar(r2) {
+		op |= emptyUnicodeWordBoundary
+	} else {
+		op |= emptyUnicodeNoWordBoundary
+	}
+	return op
+}
+
+// hasBoundaryMarkers reports whether names, the group names of a compiled
+// pattern, include Unicode word boundary markers.
+func hasBoundaryMarkers(names []string) bool {
+	for _, name := range names {
+		if isBoundaryMarker(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBoundaryMarker(name string) bool {
+	return name == unicodeWordBoundaryName || name == unicodeNoWordBoundaryName
+}
+
+// stripBoundaryMarkers replaces the boundary markers in expr with empty
+// non-capturing groups, leaving the pattern the standard library should see.
+func stripBoundaryMarkers(expr string) string {
+	return strings.NewReplacer(unicodeWordBoundaryMarker, "(?:)", unicodeNoWordBoundaryMarker, "(?:)").Replace(expr)
+}
+
+// parseMachineExpr parses expr for the machine. Boundary markers are
+// renumbered to markerCapBase and above, and the remaining groups are
+// numbered as they are in the stripped pattern, so that newProgram can turn
+// the markers into assertions.
+func parseMachineExpr(expr string) (*syntax.Regexp, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil || !strings.Contains(expr, markerPrefix) {
+		return re, err
+	}
+	next := 1
+	var renumber func(re *syntax.Regexp)
+	renumber = func(re *syntax.Regexp) {
+		if re.Op == syntax.OpCapture {
+			switch re.Name {
+			case unicodeWordBoundaryName:
+				re.Cap, re.Name = markerCapBase, ""
+			case unicodeNoWordBoundaryName:
+				re.Cap, re.Name = markerCapBase+1, ""
+			default:
+				re.Cap = next
+				next++
+			}
+		}
+		for _, sub := range re.Sub {
+			renumber(sub)
+		}
+	}
+	renumber(re)
+	return re, nil
+}
+
+// convertBoundaryMarkers rewrites the captures of boundary markers in prog
+// into empty-width assertions and returns the number of submatch indices
+// recorded by the remaining groups.
+func convertBoundaryMarkers(prog *syntax.Prog) int {
+	ncap := 2
+	for i := range prog.Inst {
+		inst := &prog.Inst[i]
+		if inst.Op != syntax.InstCapture {
+			continue
+		}
+		if inst.Arg < 2*markerCapBase {
+			ncap = max(ncap, int(inst.Arg)+1)
+			continue
+		}
+		switch inst.Arg - 2*markerCapBase {
+		case 0:
+			inst.Op, inst.Arg = syntax.InstEmptyWidth, uint32(emptyUnicodeWordBoundary)
+		case 2:
+			inst.Op, inst.Arg = syntax.InstEmptyWidth, uint32(emptyUnicodeNoWordBoundary)
+		default:
+			inst.Op = syntax.InstNop
+		}
+	}
+	return ncap
+}
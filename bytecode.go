@@ -1,53 +1,198 @@
 package tinyrebuilder
 
 import (
+	"context"
 	"regexp"
+	"regexp/syntax"
+	"sync"
 )
 
 // Regexp is a wrapper around the standard library's *regexp.Regexp.
 // It provides all the methods of the original, allowing it to be used as a
 // drop-in replacement where a *regexp.Regexp is expected.
 type Regexp struct {
-	re *regexp.Regexp
+	re     *regexp.Regexp
+	fast   *fastPaths
+	vm     *vmState
+	limits Limits
+	// expr, if set, is the source of a pattern with Unicode word boundaries,
+	// which re lacks. Such patterns are always matched on the machine.
+	expr string
+	// longest reports leftmost-longest matching.
+	longest bool
+}
+
+// fastPaths holds the literal matcher and the prefilter of a Regexp, which
+// are found by analyzing its pattern on first use, so that compiling a
+// pattern that is never matched costs no more than with the standard
+// library.
+type fastPaths struct {
+	once sync.Once
+	lit  *literalMatcher
+	pre  *prefilter
+}
+
+// newRegexp wraps a compiled expression. Its pattern is analyzed on first use
+// for literal shapes that can be matched directly and for literals that let
+// matching skip input the engine need not see.
+func newRegexp(re *regexp.Regexp) *Regexp {
+	return newRegexpOptions(re, Options{})
+}
+
+// newRegexpOptions is like newRegexp for an expression compiled with opts.
+func newRegexpOptions(re *regexp.Regexp, opts Options) *Regexp {
+	r := &Regexp{re: re, fast: &fastPaths{}, vm: &vmState{}, longest: opts.Longest}
+	if hasBoundaryMarkers(re.SubexpNames()) {
+		// The stripped pattern differs only in lacking the markers, so it
+		// compiles whenever the original did.
+		r.expr = re.String()
+		r.re = regexp.MustCompile(stripBoundaryMarkers(r.expr))
+		if r.longest {
+			r.re.Longest()
+		}
+	}
+	if opts.NoOptimize {
+		// Settle the fast paths as absent.
+		r.fast.once.Do(func() {})
+	}
+	return r
+}
+
+// analyze finds the fast paths of r, once.
+func (r *Regexp) analyze() *fastPaths {
+	f := r.fast
+	f.once.Do(func() {
+		tree, err := syntax.Parse(r.re.String(), syntax.Perl)
+		if err != nil {
+			return
+		}
+		tree = tree.Simplify()
+		// The literal matcher finds leftmost-first matches.
+		if r.re.NumSubexp() == 0 && r.expr == "" && !r.longest {
+			f.lit = newLiteralMatcher(tree)
+		}
+		if f.lit == nil {
+			f.pre = newPrefilter(tree)
+		}
+	})
+	return f
+}
+
+// plain reports whether r has neither fast paths nor Unicode word
+// boundaries, so that the standard library matches it unaided.
+func (r *Regexp) plain() bool {
+	f := r.analyze()
+	return f.lit == nil && f.pre == nil && r.expr == ""
+}
+
+// prefilter returns the prefilter of r, or nil if r has none.
+func (r *Regexp) prefilter() *prefilter {
+	return r.analyze().pre
 }
 
 // IsMatch checks if the compiled regular expression matches the string.
 func (r *Regexp) IsMatch(s string) bool {
-	return r.re.MatchString(s)
+	return r.MatchString(s)
 }
 
 // FindStringSubmatch returns a slice of strings holding the text of the
 // leftmost match of the regular expression in s and the matches, if any, for
 // its subexpressions.
 func (r *Regexp) FindStringSubmatch(s string) []string {
+	switch f := r.analyze(); {
+	case r.expr != "":
+		return submatchStrings(s, r.findSubmatchIndexWith(nil, nil, s))
+	case f.lit != nil:
+		if start, end, ok := f.lit.index(s); ok {
+			return []string{s[start:end]}
+		}
+		return nil
+	case f.pre != nil:
+		return submatchStrings(s, f.pre.findIndex(r.re, s))
+	}
 	return r.re.FindStringSubmatch(s)
 }
 
 // FindAllString finds all successive non-overlapping matches of the Regexp in a string.
 func (r *Regexp) FindAllString(s string, n int) []string {
-	return r.re.FindAllString(s, n)
+	if r.plain() {
+		return r.re.FindAllString(s, n)
+	}
+	var out []string
+	for _, loc := range r.findAll(s, n) {
+		out = append(out, s[loc[0]:loc[1]])
+	}
+	return out
 }
 
 // FindAllStringIndex finds all successive non-overlapping matches of the Regexp in a string
 // and returns a slice of pairs of indices.
 func (r *Regexp) FindAllStringIndex(s string, n int) [][]int {
-	return r.re.FindAllStringIndex(s, n)
+	if r.plain() {
+		return r.re.FindAllStringIndex(s, n)
+	}
+	out := r.findAll(s, n)
+	for i, loc := range out {
+		out[i] = loc[:2]
+	}
+	return out
 }
 
 // FindAllStringSubmatch finds all successive non-overlapping matches of the Regexp in a string
 // and returns a slice of slices of strings.
 func (r *Regexp) FindAllStringSubmatch(s string, n int) [][]string {
-	return r.re.FindAllStringSubmatch(s, n)
+	if r.plain() {
+		return r.re.FindAllStringSubmatch(s, n)
+	}
+	var out [][]string
+	for _, loc := range r.findAll(s, n) {
+		out = append(out, submatchStrings(s, loc))
+	}
+	return out
 }
 
 // FindString finds the text of the leftmost match in a string.
 func (r *Regexp) FindString(s string) string {
+	switch f := r.analyze(); {
+	case r.expr != "":
+		if loc := r.findSubmatchIndexWith(nil, nil, s); loc != nil {
+			return s[loc[0]:loc[1]]
+		}
+		return ""
+	case f.lit != nil:
+		if start, end, ok := f.lit.index(s); ok {
+			return s[start:end]
+		}
+		return ""
+	case f.pre != nil:
+		if loc := f.pre.findIndex(r.re, s); loc != nil {
+			return s[loc[0]:loc[1]]
+		}
+		return ""
+	}
 	return r.re.FindString(s)
 }
 
 // FindStringIndex returns a two-element slice of integers defining the location of
 // the leftmost match in a string.
 func (r *Regexp) FindStringIndex(s string) []int {
+	switch f := r.analyze(); {
+	case r.expr != "":
+		if loc := r.findSubmatchIndexWith(nil, nil, s); loc != nil {
+			return loc[:2]
+		}
+		return nil
+	case f.lit != nil:
+		if start, end, ok := f.lit.index(s); ok {
+			return []int{start, end}
+		}
+		return nil
+	case f.pre != nil:
+		if loc := f.pre.findIndex(r.re, s); loc != nil {
+			return loc[:2]
+		}
+		return nil
+	}
 	return r.re.FindStringIndex(s)
 }
 
@@ -66,6 +211,30 @@ func (r *Regexp) ExpandString(dst []byte, template string, src string, match []i
 	return r.re.ExpandString(dst, template, src, match)
 }
 
+// ReplaceAllString returns a copy of s, replacing matches of the Regexp with
+// the replacement string repl. Inside repl, $ signs are interpreted as in Expand.
+func (r *Regexp) ReplaceAllString(s, repl string) string {
+	return r.replaceAll(s, -1, func(dst []byte, loc []int) []byte {
+		return r.re.ExpandString(dst, repl, s, loc)
+	})
+}
+
+// ReplaceAllLiteralString returns a copy of s, replacing matches of the Regexp
+// with the replacement string repl, which is substituted directly.
+func (r *Regexp) ReplaceAllLiteralString(s, repl string) string {
+	return r.replaceAll(s, -1, func(dst []byte, loc []int) []byte {
+		return append(dst, repl...)
+	})
+}
+
+// ReplaceAllStringFunc returns a copy of s in which all matches of the Regexp
+// have been replaced by the return value of repl applied to the matched text.
+func (r *Regexp) ReplaceAllStringFunc(s string, repl func(string) string) string {
+	return r.replaceAll(s, -1, func(dst []byte, loc []int) []byte {
+		return append(dst, repl(s[loc[0]:loc[1]])...)
+	})
+}
+
 // LiteralPrefix returns a literal string that must begin any match of the Regexp.
 func (r *Regexp) LiteralPrefix() (prefix string, complete bool) {
 	return r.re.LiteralPrefix()
@@ -73,6 +242,15 @@ func (r *Regexp) LiteralPrefix() (prefix string, complete bool) {
 
 // MatchString reports whether the Regexp matches the string s.
 func (r *Regexp) MatchString(s string) bool {
+	switch f := r.analyze(); {
+	case r.expr != "":
+		return r.matchMachine(s)
+	case f.lit != nil:
+		_, _, ok := f.lit.index(s)
+		return ok
+	case f.pre != nil:
+		return f.pre.match(r.re, s)
+	}
 	return r.re.MatchString(s)
 }
 
@@ -83,10 +261,75 @@ func (r *Regexp) NumSubexp() int {
 
 // String returns the source text of the regular expression.
 func (r *Regexp) String() string {
+	if r.expr != "" {
+		return r.expr
+	}
 	return r.re.String()
 }
 
-// Unwrap returns the underlying *regexp.Regexp object.
+// Unwrap returns the underlying *regexp.Regexp object. For a pattern with
+// Unicode word boundaries, it is the pattern without them.
 func (r *Regexp) Unwrap() *regexp.Regexp {
 	return r.re
 }
+
+// findAll returns the submatch indices of up to n successive matches using
+// the literal fast path or prefilter.
+func (r *Regexp) findAll(s string, n int) [][]int {
+	f := r.analyze()
+	switch {
+	case r.expr != "":
+		locs, _ := r.findAllMachine(context.Background(), s, n, r.program().ncap)
+		return locs
+	case f.lit != nil:
+		return f.lit.allIndex(s, n)
+	}
+	return f.pre.findAll(r.re, s, n)
+}
+
+// findAllSubmatchIndex returns the submatch indices of up to n successive
+// matches (all of them if n < 0).
+func (r *Regexp) findAllSubmatchIndex(s string, n int) [][]int {
+	if r.plain() {
+		return r.re.FindAllStringSubmatchIndex(s, n)
+	}
+	return r.findAll(s, n)
+}
+
+// replaceAll replaces up to n successive matches in s (all of them if n < 0)
+// with the output of repl, which appends the replacement for the match with
+// submatch indices loc to dst.
+func (r *Regexp) replaceAll(s string, n int, repl func(dst []byte, loc []int) []byte) string {
+	return spliceMatches(s, r.findAllSubmatchIndex(s, n), repl)
+}
+
+// spliceMatches returns a copy of s with each match in locs replaced by the
+// output of repl.
+func spliceMatches(s string, locs [][]int, repl func(dst []byte, loc []int) []byte) string {
+	if locs == nil {
+		return s
+	}
+	var buf []byte
+	last := 0
+	for _, loc := range locs {
+		buf = append(buf, s[last:loc[0]]...)
+		buf = repl(buf, loc)
+		last = loc[1]
+	}
+	buf = append(buf, s[last:]...)
+	return string(buf)
+}
+
+// submatchStrings converts submatch indices into the corresponding strings.
+func submatchStrings(s string, loc []int) []string {
+	if loc == nil {
+		return nil
+	}
+	out := make([]string, len(loc)/2)
+	for i := range out {
+		if loc[2*i] >= 0 {
+			out[i] = s[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	return out
+}
@@ -0,0 +1,312 @@
+package tinyrebuilder
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// ByteRegexp is a regular expression that matches []byte input one byte at a
+// time, without decoding UTF-8. Every byte is read as the rune of the same
+// value, so a pattern rune between U+0000 and U+00FF matches the byte with
+// that value, and runes above U+00FF match nothing. Classes and case folding
+// therefore follow Latin-1: `\w` matches ASCII word bytes and `(?i)é` matches
+// the bytes 0xe9 and 0xc9. A ByteRegexp is safe for concurrent use.
+type ByteRegexp struct {
+	expr     string
+	re       *regexp.Regexp
+	prog     *program
+	pre      *prefilter
+	machines sync.Pool
+}
+
+// CompileBytes compiles the expression built by r for byte matching and
+// returns the builder to the pool. It is meant for builders created with
+// NewBytes, but any builder may be compiled this way.
+func (r *RegexBuilder) CompileBytes() (*ByteRegexp, error) {
+	expr := r.builder.String()
+	r.release()
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := parseMachineExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newProgram(tree)
+	if err != nil {
+		return nil, err
+	}
+	b := &ByteRegexp{expr: expr, re: re, prog: p}
+	if hasBoundaryMarkers(re.SubexpNames()) {
+		b.re = regexp.MustCompile(stripBoundaryMarkers(expr))
+	}
+	b.pre = newBytePrefilter(tree.Simplify())
+	return b, nil
+}
+
+// MustCompileBytes is like CompileBytes, but panics if the expression cannot
+// be compiled.
+func (r *RegexBuilder) MustCompileBytes() *ByteRegexp {
+	re, err := r.CompileBytes()
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// newBytePrefilter builds a prefilter whose literals are byte strings. A
+// required literal holding a rune above U+00FF can never occur in the input,
+// so such literals are dropped.
+func newBytePrefilter(re *syntax.Regexp) *prefilter {
+	var lits []string
+	for _, lit := range analyzeLiterals(re).best() {
+		if b, err := latin1Encode(lit); err == nil {
+			lits = append(lits, string(b))
+		}
+	}
+	if literalScore(lits) <= 0 {
+		return nil
+	}
+	return &prefilter{lits: lits}
+}
+
+// String returns the source text used to compile the regular expression.
+func (b *ByteRegexp) String() string {
+	return b.expr
+}
+
+// NumSubexp returns the number of parenthesized subexpressions.
+func (b *ByteRegexp) NumSubexp() int {
+	return b.re.NumSubexp()
+}
+
+// SubexpNames returns the names of the parenthesized subexpressions.
+func (b *ByteRegexp) SubexpNames() []string {
+	return b.re.SubexpNames()
+}
+
+// Match reports whether the byte slice contains any match of the regular
+// expression.
+func (b *ByteRegexp) Match(s []byte) bool {
+	return b.find(s, 0) != nil
+}
+
+// Find returns a slice holding the text of the leftmost match in s, or nil
+// if there is none.
+func (b *ByteRegexp) Find(s []byte) []byte {
+	loc := b.find(s, 2)
+	if loc == nil {
+		return nil
+	}
+	return s[loc[0]:loc[1]:loc[1]]
+}
+
+// FindIndex returns the byte offsets of the leftmost match in s, or nil if
+// there is none.
+func (b *ByteRegexp) FindIndex(s []byte) []int {
+	return b.find(s, 2)
+}
+
+// FindSubmatch returns the text of the leftmost match in s and of its
+// subexpressions, or nil if there is no match.
+func (b *ByteRegexp) FindSubmatch(s []byte) [][]byte {
+	return submatchBytes(s, b.find(s, b.prog.ncap))
+}
+
+// FindSubmatchIndex returns the byte offsets of the leftmost match in s and
+// of its subexpressions, or nil if there is no match.
+func (b *ByteRegexp) FindSubmatchIndex(s []byte) []int {
+	return b.find(s, b.prog.ncap)
+}
+
+// FindAll returns the text of successive non-overlapping matches in s. If
+// n >= 0, at most n matches are returned.
+func (b *ByteRegexp) FindAll(s []byte, n int) [][]byte {
+	locs := b.findAll(s, n, 2)
+	if locs == nil {
+		return nil
+	}
+	out := make([][]byte, len(locs))
+	for i, loc := range locs {
+		out[i] = s[loc[0]:loc[1]:loc[1]]
+	}
+	return out
+}
+
+// FindAllIndex returns the byte offsets of successive non-overlapping matches
+// in s. If n >= 0, at most n matches are returned.
+func (b *ByteRegexp) FindAllIndex(s []byte, n int) [][]int {
+	return b.findAll(s, n, 2)
+}
+
+// FindAllSubmatch is the 'All' version of FindSubmatch.
+func (b *ByteRegexp) FindAllSubmatch(s []byte, n int) [][][]byte {
+	locs := b.findAll(s, n, b.prog.ncap)
+	if locs == nil {
+		return nil
+	}
+	out := make([][][]byte, len(locs))
+	for i, loc := range locs {
+		out[i] = submatchBytes(s, loc)
+	}
+	return out
+}
+
+// FindAllSubmatchIndex is the 'All' version of FindSubmatchIndex.
+func (b *ByteRegexp) FindAllSubmatchIndex(s []byte, n int) [][]int {
+	return b.findAll(s, n, b.prog.ncap)
+}
+
+// ReplaceAll returns a copy of src with each match replaced by repl, in which
+// $1 and ${name} are expanded as in the standard library's Expand.
+func (b *ByteRegexp) ReplaceAll(src, repl []byte) []byte {
+	return spliceMatchBytes(src, b.findAll(src, -1, b.prog.ncap), func(dst []byte, loc []int) []byte {
+		return b.re.Expand(dst, repl, src, loc)
+	})
+}
+
+// ReplaceAllLiteral returns a copy of src with each match replaced by repl,
+// which is used as it is.
+func (b *ByteRegexp) ReplaceAllLiteral(src, repl []byte) []byte {
+	return spliceMatchBytes(src, b.findAll(src, -1, 2), func(dst []byte, _ []int) []byte {
+		return append(dst, repl...)
+	})
+}
+
+// ReplaceAllFunc returns a copy of src with each match replaced by the result
+// of calling repl on the matched bytes.
+func (b *ByteRegexp) ReplaceAllFunc(src []byte, repl func([]byte) []byte) []byte {
+	return spliceMatchBytes(src, b.findAll(src, -1, 2), func(dst []byte, loc []int) []byte {
+		return append(dst, repl(src[loc[0]:loc[1]:loc[1]])...)
+	})
+}
+
+func (b *ByteRegexp) getMachine() *machine {
+	if m, ok := b.machines.Get().(*machine); ok {
+		return m
+	}
+	m := newMachine(b.prog)
+	m.bytes = true
+	return m
+}
+
+// find returns the first ncap submatch indices of the leftmost match in s,
+// or nil if there is none. With ncap 0 it returns an empty slice on a match.
+func (b *ByteRegexp) find(s []byte, ncap int) []int {
+	str := byteString(s)
+	if !b.pre.mayMatch(str) {
+		return nil
+	}
+	m := b.getMachine()
+	defer b.machines.Put(m)
+	m.init(ncap)
+	if !m.match(str, 0, false) {
+		return nil
+	}
+	return append([]int{}, m.matchcap...)
+}
+
+// findAll returns the first ncap submatch indices of up to n successive
+// non-overlapping matches in s.
+func (b *ByteRegexp) findAll(s []byte, n, ncap int) [][]int {
+	str := byteString(s)
+	if n == 0 || !b.pre.mayMatch(str) {
+		return nil
+	}
+	m := b.getMachine()
+	defer b.machines.Put(m)
+	m.init(ncap)
+	locs, _ := m.findAll(str, n)
+	return locs
+}
+
+// byteString returns a string sharing the memory of s. The machine only
+// reads its input, and no string derived from it outlives the call that
+// created it.
+func byteString(s []byte) string {
+	return unsafe.String(unsafe.SliceData(s), len(s))
+}
+
+// spliceMatchBytes is the []byte version of spliceMatches.
+func spliceMatchBytes(src []byte, locs [][]int, repl func(dst []byte, loc []int) []byte) []byte {
+	buf := make([]byte, 0, len(src))
+	last := 0
+	for _, loc := range locs {
+		buf = append(buf, src[last:loc[0]]...)
+		buf = repl(buf, loc)
+		last = loc[1]
+	}
+	return append(buf, src[last:]...)
+}
+
+// submatchBytes converts submatch indices into the corresponding slices of s.
+func submatchBytes(s []byte, loc []int) [][]byte {
+	if loc == nil {
+		return nil
+	}
+	out := make([][]byte, len(loc)/2)
+	for i := range out {
+		if loc[2*i] >= 0 {
+			out[i] = s[loc[2*i]:loc[2*i+1]:loc[2*i+1]]
+		}
+	}
+	return out
+}
+
+// Latin1Error reports a rune that cannot be encoded in Latin-1.
+type Latin1Error struct {
+	// Offset is the byte offset of the rune in the UTF-8 input.
+	Offset int
+	// Rune is the rune, or utf8.RuneError for invalid UTF-8.
+	Rune rune
+}
+
+func (e *Latin1Error) Error() string {
+	if e.Rune == utf8.RuneError {
+		return fmt.Sprintf("tinyrebuilder: invalid UTF-8 at offset %d", e.Offset)
+	}
+	return fmt.Sprintf("tinyrebuilder: %U at offset %d is not in Latin-1", e.Rune, e.Offset)
+}
+
+// ToLatin1 encodes the UTF-8 text s in Latin-1, one byte per rune. It returns
+// a *Latin1Error if s holds a rune above U+00FF or invalid UTF-8. Use it to
+// pass text written in Go source, such as "café", to Literal or AnyOf of a
+// byte-mode builder that matches Latin-1 input.
+func ToLatin1(s string) (string, error) {
+	b, err := latin1Encode(s)
+	return string(b), err
+}
+
+// FromLatin1 decodes the Latin-1 bytes b to UTF-8 text. Every byte sequence
+// is valid Latin-1, so it never fails. A pattern stored in Latin-1, such as
+// one read from a legacy configuration file, becomes a valid expression for
+// Raw once decoded, and a byte-mode Regexp compiled from it matches the same
+// Latin-1 text the original bytes described.
+func FromLatin1(b []byte) string {
+	buf := make([]byte, 0, len(b))
+	for _, c := range b {
+		buf = utf8.AppendRune(buf, rune(c))
+	}
+	return string(buf)
+}
+
+// latin1Encode encodes s in Latin-1, reporting the first rune that does not
+// fit.
+func latin1Encode(s string) ([]byte, error) {
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		r, width := utf8.DecodeRuneInString(s[i:])
+		if r > 0xff || r == utf8.RuneError && width == 1 {
+			return nil, &Latin1Error{Offset: i, Rune: r}
+		}
+		buf = append(buf, byte(r))
+		i += width
+	}
+	return buf, nil
+}
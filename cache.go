@@ -1,56 +1,246 @@
 package tinyrebuilder
 
 import (
+	"expvar"
 	"fmt"
-	"regexp"
-
-	lru "github.com/hashicorp/golang-lru"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	defaultCacheSize = 128
-	cache, _         = lru.New(defaultCacheSize)
-)
+var defaultCacheSize = 128
+
+func init() {
+	defaultCompiler.PublishStats("tinyrebuilder.cache")
+}
 
 // MustCompileWithCache is like MustCompile but uses a package-level LRU cache
 // to store and retrieve compiled regular expressions. This is highly recommended
 // for performance in high-load applications where the same regex patterns are
-// built frequently.
+// built frequently. The cache belongs to a default Compiler; use NewCompiler
+// for a cache of your own.
 func (r *RegexBuilder) MustCompileWithCache() *Regexp {
-	pattern := r.Build()
-	if val, ok := cache.Get(pattern); ok {
-		if re, ok := val.(*Regexp); ok {
-			return re
-		}
-	}
-
-	re, err := regexp.Compile(pattern)
+	re, err := r.CompileWithCache()
 	if err != nil {
 		panic(err)
 	}
-	wrappedRe := &Regexp{re: re}
-	cache.Add(pattern, wrappedRe)
+	return re
+}
 
-	return wrappedRe
+// CompileWithCache is like MustCompileWithCache but returns an error instead
+// of panicking, so the cache can serve user-supplied patterns. Failures are
+// cached too, in a separate, smaller cache, so a pattern that is submitted
+// again after failing returns the same error without being parsed.
+func (r *RegexBuilder) CompileWithCache() (*Regexp, error) {
+	return defaultCompiler.compile(CacheKey{Pattern: r.Build()})
+}
+
+// CompileWithCacheOptions is like CompileWithCache, compiling with the given
+// options. The options are part of the cache key, so the same pattern
+// compiled in different modes yields distinct entries.
+func (r *RegexBuilder) CompileWithCacheOptions(opts Options) (*Regexp, error) {
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return defaultCompiler.compile(CacheKey{Pattern: r.Build(), Options: opts})
 }
 
 // PurgeCache completely clears the regex cache.
 func PurgeCache() {
-	cache.Purge()
+	defaultCompiler.Purge()
+}
+
+// CachedCompileErrors returns the patterns in the package-level error cache
+// with the errors they failed to compile with.
+func CachedCompileErrors() map[string]error {
+	return defaultCompiler.CachedErrors()
+}
+
+// PurgeErrorCache clears the package-level cache of compile failures.
+func PurgeErrorCache() {
+	defaultCompiler.PurgeErrors()
+}
+
+// SetCacheEvictCallback sets a function to be called with each pattern the
+// package-level cache evicts to make room for another. A nil fn removes it.
+func SetCacheEvictCallback(fn func(pattern string, re *Regexp)) {
+	defaultCompiler.SetEvictCallback(fn)
+}
+
+// CacheStats returns a snapshot of the statistics of the package-level
+// cache. They are also published through expvar as "tinyrebuilder.cache".
+func CacheStats() CacheMetrics {
+	return defaultCompiler.Stats()
+}
+
+// WarmCache compiles the patterns of a manifest read from r into the
+// package-level cache, as Compiler.Warm does, so that a program can start
+// with the working set of an earlier run.
+func WarmCache(r io.Reader) error {
+	return defaultCompiler.Warm(r)
+}
+
+// DumpCacheManifest writes the patterns in the package-level cache to w,
+// from the most to the least recently used, in the format WarmCache reads.
+func DumpCacheManifest(w io.Writer) error {
+	return defaultCompiler.DumpManifest(w)
+}
+
+// CacheMetrics is a snapshot of the statistics of a Compiler's cache.
+type CacheMetrics struct {
+	// Hits is the number of compilations served from the cache.
+	Hits uint64
+	// ErrorHits is the number of compilations that failed with a cached
+	// error.
+	ErrorHits uint64
+	// Misses is the number of compilations not found in either cache.
+	// Concurrent misses for the same pattern share one compilation.
+	Misses uint64
+	// Evictions is the number of patterns evicted to make room for others.
+	Evictions uint64
+	// Compilations is the number of patterns actually compiled, and
+	// CompileTime the total time spent compiling them.
+	Compilations uint64
+	CompileTime  time.Duration
+	// Size is the number of patterns in the cache, and Capacity the number
+	// it can hold. Both are zero when caching is disabled.
+	Size, Capacity int
+	// Bytes is the estimated memory held by the cached patterns, for
+	// backends that weigh their entries, such as those of NewCostCache. It
+	// is zero for other backends.
+	Bytes int64
+}
+
+// cacheCounters accumulates the statistics of a Compiler. The counters that
+// every lookup updates are striped, so that concurrent hits do not contend
+// for one cache line.
+type cacheCounters struct {
+	hits, errorHits, misses stripedCounter
+	evictions, compilations atomic.Uint64
+	compileNanos            atomic.Int64
+}
+
+// counterStripes is the number of cells a stripedCounter spreads over.
+const counterStripes = 16
+
+// stripedCounter is a counter whose increments land on a randomly chosen
+// cell, each on its own cache line, and whose value is their sum.
+type stripedCounter struct {
+	cells [counterStripes]struct {
+		atomic.Uint64
+		_ [56]byte
+	}
+}
+
+func (c *stripedCounter) Add(n uint64) {
+	c.cells[rand.Uint32()%counterStripes].Add(n)
+}
+
+func (c *stripedCounter) Load() uint64 {
+	var n uint64
+	for i := range c.cells {
+		n += c.cells[i].Load()
+	}
+	return n
+}
+
+// Stats returns a snapshot of the statistics of the Compiler's cache.
+func (c *Compiler) Stats() CacheMetrics {
+	st := CacheMetrics{
+		Hits:         c.stats.hits.Load(),
+		ErrorHits:    c.stats.errorHits.Load(),
+		Misses:       c.stats.misses.Load(),
+		Evictions:    c.stats.evictions.Load(),
+		Compilations: c.stats.compilations.Load(),
+		CompileTime:  time.Duration(c.stats.compileNanos.Load()),
+	}
+	if cache := c.cache.Load(); cache != nil {
+		st.Size, st.Capacity = cache.Len(), cache.size
+		if weighed, ok := cache.Cache.(interface{ Bytes() int64 }); ok {
+			st.Bytes = weighed.Bytes()
+		}
+	}
+	return st
+}
+
+// PublishStats publishes the statistics of the Compiler through expvar under
+// name. Like expvar.Publish, it panics if name is already in use.
+func (c *Compiler) PublishStats(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return c.Stats() }))
+}
+
+// SetCacheBackend replaces the package-level cache with an empty one created
+// by backend, such as NewARCCache, keeping its size.
+func SetCacheBackend(backend CacheFactory) error {
+	return defaultCompiler.SetCacheBackend(backend)
+}
+
+// SetCacheCanonicalKeys selects whether the package-level cache stores
+// patterns under their canonical form, so that patterns differing only in
+// spelling share an entry. See CompilerOptions.CanonicalKeys.
+func SetCacheCanonicalKeys(on bool) {
+	defaultCompiler.SetCanonicalKeys(on)
 }
 
 // SetCacheSize changes the size of the LRU cache. Note that this will purge
-// the existing cache.
+// the existing cache. It is safe to call while other goroutines compile
+// patterns with the cache.
 func SetCacheSize(size int) error {
 	if size <= 0 {
 		return fmt.Errorf("cache size must be positive")
 	}
-	var err error
-	cache, err = lru.New(size)
-	if err != nil {
-		// Fallback to default if something goes wrong
-		cache, _ = lru.New(defaultCacheSize)
-		return err
+	return defaultCompiler.SetCacheSize(size)
+}
+
+// flightGroup coalesces concurrent compilations of the same pattern, so that
+// a pattern missing from the cache is compiled once however many goroutines
+// ask for it, and all of them receive the same Regexp.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[CacheKey]*flight
+}
+
+// flight is a compilation in progress.
+type flight struct {
+	done chan struct{}
+	re   *Regexp
+	err  error
+}
+
+// do runs fn for key unless a call for key is already running, in which case
+// it waits for that call and returns its result.
+func (g *flightGroup) do(key CacheKey, fn func() (*Regexp, error)) (*Regexp, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.re, f.err
+	}
+	if g.calls == nil {
+		g.calls = make(map[CacheKey]*flight)
 	}
-	return nil
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		// A panic in fn fails the waiters instead of handing them a nil
+		// Regexp, and then carries on in the caller.
+		v := recover()
+		if v != nil {
+			f.re, f.err = nil, fmt.Errorf("tinyrebuilder: compilation of %q panicked: %v", key.Pattern, v)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(f.done)
+		if v != nil {
+			panic(v)
+		}
+	}()
+	f.re, f.err = fn()
+	return f.re, f.err
 }
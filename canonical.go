@@ -0,0 +1,99 @@
+package tinyrebuilder
+
+import (
+	"hash/fnv"
+	"regexp/syntax"
+)
+
+// canonicalExpr returns the canonical form of pattern, parsed with flags: the
+// simplified syntax tree rendered back to Perl syntax. Patterns that differ
+// only in spelling, such as a|b, [ab] and (?:b|a), share a canonical form,
+// and the form compiles to a Regexp with the same capture groups as the
+// pattern.
+func canonicalExpr(pattern string, flags syntax.Flags) (string, error) {
+	re, err := syntax.Parse(pattern, flags)
+	if err != nil {
+		return "", err
+	}
+	plain := re.String()
+	simple := re.Simplify().String()
+	if simple == plain {
+		return plain, nil
+	}
+	// Simplifying a repeated group, as in (a){3}, copies its capture, so
+	// the rendering of the simplified tree is only used if it keeps them.
+	sre, err := syntax.Parse(simple, syntax.Perl)
+	if err != nil || !sameCaptures(re, sre) {
+		return plain, nil
+	}
+	return simple, nil
+}
+
+// sameCaptures reports whether a and b have the same capture groups.
+func sameCaptures(a, b *syntax.Regexp) bool {
+	if a.MaxCap() != b.MaxCap() {
+		return false
+	}
+	an, bn := a.CapNames(), b.CapNames()
+	for i := range an {
+		if an[i] != bn[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// canonical returns the key under which the canonical form of k is cached,
+// or false if the pattern of k does not parse. The flags and POSIX syntax of
+// the options are applied to the canonical form, so the options of the key
+// keep only what the form cannot express.
+func (k CacheKey) canonical() (CacheKey, bool) {
+	expr, err := canonicalExpr(k.Pattern, k.Options.syntaxFlags())
+	if err != nil {
+		return k, false
+	}
+	k.Pattern = expr
+	k.Options.POSIX, k.Options.Flags = false, ""
+	return k, true
+}
+
+// fingerprint hashes a canonical form with the matching semantics it is
+// compiled with.
+func fingerprint(expr string, longest bool) uint64 {
+	h := fnv.New64a()
+	if longest {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(expr))
+	return h.Sum64()
+}
+
+// Fingerprint returns a hash of the canonical form of the regular expression
+// built so far, in which patterns that differ only in spelling, such as a|b,
+// [ab] and (?:b|a), are equal. The hash depends on nothing but the pattern,
+// so it can identify patterns across processes; the canonical form comes
+// from regexp/syntax, which may render it differently in other Go releases.
+// It equals the Fingerprint of the Regexp that Compile returns. A pattern
+// that does not parse is hashed as written.
+func (r *RegexBuilder) Fingerprint() uint64 {
+	pattern := r.Build()
+	if expr, err := canonicalExpr(pattern, syntax.Perl); err == nil {
+		pattern = expr
+	}
+	return fingerprint(pattern, false)
+}
+
+// Fingerprint returns a hash of the canonical form of r and its matching
+// semantics, as RegexBuilder.Fingerprint does. Regexps that match the same
+// text the same way, however their patterns are spelled, have the same
+// Fingerprint; a Regexp compiled for leftmost-longest matching has a
+// different one.
+func (r *Regexp) Fingerprint() uint64 {
+	expr := r.String()
+	if canon, err := canonicalExpr(expr, syntax.Perl); err == nil {
+		expr = canon
+	}
+	return fingerprint(expr, r.longest)
+}
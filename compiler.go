@@ -0,0 +1,382 @@
+package tinyrebuilder
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// CompilerOptions configures a Compiler.
+type CompilerOptions struct {
+	// CacheSize is the number of compiled patterns the Compiler keeps. If it
+	// is zero, 128 is used; if it is negative, nothing is cached.
+	CacheSize int
+	// ErrorCacheSize is the number of failed compilations the Compiler
+	// remembers, so that a pattern known to be invalid fails without being
+	// parsed again. If it is zero, 64 is used; if it is negative, failures
+	// are not cached.
+	ErrorCacheSize int
+	// Policy, if set, is checked against every pattern before it is
+	// compiled, as by CompileUntrusted.
+	Policy *CompilePolicy
+	// OnEvict, if set, is called with each pattern the cache evicts to make
+	// room for another. It is not called for patterns removed by Purge or
+	// SetCacheSize.
+	OnEvict func(pattern string, re *Regexp)
+	// Backend creates the cache of compiled patterns. If it is nil,
+	// NewLRUCache is used.
+	Backend CacheFactory
+	// CanonicalKeys caches patterns under their canonical form, so that
+	// patterns differing only in spelling, such as a|b and [ab], share an
+	// entry. The first lookup of each spelling parses its pattern, and the
+	// String method of a cached Regexp returns the canonical form.
+	CanonicalKeys bool
+}
+
+// Compiler compiles the patterns of RegexBuilders and caches the results.
+// Each Compiler has its own cache and settings, so independent parts of a
+// program need not share one cache. The package-level caching functions,
+// such as MustCompileWithCache, use a default Compiler. A Compiler is safe
+// for concurrent use, including while it is being reconfigured.
+type Compiler struct {
+	// cache is nil when caching is disabled. Reconfiguring or purging the
+	// Compiler swaps in a new cache, under mu.
+	cache   atomic.Pointer[patternCache]
+	mu      sync.Mutex
+	backend CacheFactory
+	// failures holds the error for each pattern that failed to compile, or is
+	// nil when failures are not cached.
+	failures *lru.Cache
+	policy   *CompilePolicy
+	flights  flightGroup
+	onEvict  atomic.Pointer[func(string, *Regexp)]
+	stats    cacheCounters
+	// canonical selects caching under canonical keys.
+	canonical atomic.Bool
+	// canonicalKeys memoizes cacheKey under canonical keys, mapping each
+	// key as written to its cachedKey, so that a cache hit does not parse
+	// the pattern again.
+	canonicalKeys *lru.Cache
+}
+
+// cachedKey is a key returned by cacheKey, with whether the policy remains
+// to be checked.
+type cachedKey struct {
+	key   CacheKey
+	check bool
+}
+
+// patternCache is a cache of compiled patterns with its capacity.
+type patternCache struct {
+	Cache
+	size int
+}
+
+// defaultErrorCacheSize is the size of the error cache when
+// CompilerOptions.ErrorCacheSize is not set.
+const defaultErrorCacheSize = 64
+
+// canonicalKeysSize is the number of keys whose canonical form a Compiler
+// remembers.
+const canonicalKeysSize = 1024
+
+// defaultCompiler backs the package-level caching functions.
+var defaultCompiler = mustNewCompiler(CompilerOptions{CacheSize: defaultCacheSize})
+
+// NewCompiler returns a Compiler configured by opts.
+func NewCompiler(opts CompilerOptions) (*Compiler, error) {
+	c := &Compiler{}
+	c.canonical.Store(opts.CanonicalKeys)
+	var err error
+	if c.canonicalKeys, err = lru.New(canonicalKeysSize); err != nil {
+		return nil, err
+	}
+	if opts.OnEvict != nil {
+		c.onEvict.Store(&opts.OnEvict)
+	}
+	if opts.Policy != nil {
+		policy := *opts.Policy
+		c.policy = &policy
+	}
+	size := opts.CacheSize
+	if size == 0 {
+		size = defaultCacheSize
+	}
+	if err := c.reconfigure(size, opts.Backend); err != nil {
+		return nil, err
+	}
+	errSize := opts.ErrorCacheSize
+	if errSize == 0 {
+		errSize = defaultErrorCacheSize
+	}
+	if errSize > 0 {
+		if c.failures, err = lru.New(errSize); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func mustNewCompiler(opts CompilerOptions) *Compiler {
+	c, err := NewCompiler(opts)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Compile compiles the expression built by r, returning the cached Regexp if
+// the Compiler has already compiled the same pattern, and returns the
+// builder to the pool.
+func (c *Compiler) Compile(r *RegexBuilder) (*Regexp, error) {
+	return c.CompileWithOptions(r, Options{})
+}
+
+// MustCompile is like Compile but panics if the expression cannot be
+// compiled or violates the policy of the Compiler.
+func (c *Compiler) MustCompile(r *RegexBuilder) *Regexp {
+	re, err := c.Compile(r)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// CompileWithOptions is like Compile, compiling with the given options. A
+// pattern compiled with different options is cached separately; options
+// that differ only in spelling, such as the order of Flags, share an entry.
+func (c *Compiler) CompileWithOptions(r *RegexBuilder, opts Options) (*Regexp, error) {
+	pattern := r.Build()
+	r.release()
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return c.compile(CacheKey{Pattern: pattern, Options: opts})
+}
+
+// compile returns the Regexp for key, from the cache if possible. A key that
+// failed before fails again with the cached error. Concurrent calls for a key
+// that is not cached share a single compilation.
+func (c *Compiler) compile(key CacheKey) (*Regexp, error) {
+	return c.compileKey(c.cacheKey(key))
+}
+
+// cacheKey returns the key under which the Compiler caches key, which is its
+// canonical form if the Compiler uses canonical keys, and whether the policy
+// of the Compiler remains to be checked before compiling it.
+func (c *Compiler) cacheKey(key CacheKey) (CacheKey, bool) {
+	check := c.policy != nil
+	if !c.canonical.Load() {
+		return key, check
+	}
+	if val, ok := c.canonicalKeys.Get(key); ok {
+		ck := val.(cachedKey)
+		return ck.key, ck.check
+	}
+	raw := key
+	// The policy applies to the pattern as written: the canonical form of a
+	// pattern may pass where the pattern does not, or the other way round. A
+	// pattern that violates it keeps its own key, under which
+	// compileUncached reports the violation.
+	if ck, ok := key.canonical(); ok && (!check || c.allowed(key)) {
+		key, check = ck, false
+	}
+	c.canonicalKeys.Add(raw, cachedKey{key: key, check: check})
+	return key, check
+}
+
+// compileKey is like compile for a key returned by cacheKey.
+func (c *Compiler) compileKey(key CacheKey, check bool) (*Regexp, error) {
+	if re, ok, err := c.lookup(key); ok {
+		if err != nil {
+			c.stats.errorHits.Add(1)
+		} else {
+			c.stats.hits.Add(1)
+		}
+		return re, err
+	}
+	c.stats.misses.Add(1)
+	return c.flights.do(key, func() (*Regexp, error) {
+		// Another flight may have cached the key since the lookup above.
+		if re, ok, err := c.lookup(key); ok {
+			return re, err
+		}
+		re, err := c.compileUncached(key, check)
+		if err != nil {
+			if c.failures != nil {
+				c.failures.Add(key, err)
+			}
+			return nil, err
+		}
+		if cache := c.cache.Load(); cache != nil {
+			cache.Add(key, re)
+		}
+		return re, nil
+	})
+}
+
+// lookup returns the cached result for key, reporting whether there was one.
+func (c *Compiler) lookup(key CacheKey) (*Regexp, bool, error) {
+	if cache := c.cache.Load(); cache != nil {
+		if re, ok := cache.Get(key); ok {
+			return re, true, nil
+		}
+	}
+	if c.failures != nil {
+		if val, ok := c.failures.Get(key); ok {
+			return nil, true, val.(error)
+		}
+	}
+	return nil, false, nil
+}
+
+// compileUncached compiles the pattern of key, first checking it against the
+// policy of the Compiler if check is set.
+func (c *Compiler) compileUncached(key CacheKey, check bool) (*Regexp, error) {
+	start := time.Now()
+	defer func() {
+		c.stats.compilations.Add(1)
+		c.stats.compileNanos.Add(int64(time.Since(start)))
+	}()
+	if check {
+		expr, err := key.Options.expr(key.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if violations := c.policy.Check(expr); len(violations) > 0 {
+			return nil, &PolicyError{Pattern: key.Pattern, Violations: violations}
+		}
+	}
+	return compileOptions(key.Pattern, key.Options)
+}
+
+// allowed reports whether the pattern of key satisfies the policy of the
+// Compiler.
+func (c *Compiler) allowed(key CacheKey) bool {
+	expr, err := key.Options.expr(key.Pattern)
+	return err == nil && len(c.policy.Check(expr)) == 0
+}
+
+// SetCanonicalKeys selects whether the Compiler caches patterns under their
+// canonical form, as CompilerOptions.CanonicalKeys does. Patterns already
+// cached stay under the keys they were cached with.
+func (c *Compiler) SetCanonicalKeys(on bool) {
+	c.canonical.Store(on)
+}
+
+// Purge removes every pattern from the cache of the Compiler.
+func (c *Compiler) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cache := c.cache.Load(); cache != nil {
+		c.setCache(cache.size, c.backend)
+	}
+}
+
+// SetEvictCallback replaces the OnEvict callback of the Compiler. A nil fn
+// removes it.
+func (c *Compiler) SetEvictCallback(fn func(pattern string, re *Regexp)) {
+	if fn == nil {
+		c.onEvict.Store(nil)
+		return
+	}
+	c.onEvict.Store(&fn)
+}
+
+// evicted records the eviction of a cache entry and reports it to the
+// OnEvict callback.
+func (c *Compiler) evicted(key CacheKey, re *Regexp) {
+	c.stats.evictions.Add(1)
+	if fn := c.onEvict.Load(); fn != nil {
+		(*fn)(key.Pattern, re)
+	}
+}
+
+// CachedErrors returns the patterns in the error cache of the Compiler with
+// the errors they failed with. A pattern that failed with several sets of
+// options is listed once.
+func (c *Compiler) CachedErrors() map[string]error {
+	out := make(map[string]error)
+	if c.failures == nil {
+		return out
+	}
+	for _, key := range c.failures.Keys() {
+		if val, ok := c.failures.Peek(key); ok {
+			out[key.(CacheKey).Pattern] = val.(error)
+		}
+	}
+	return out
+}
+
+// PurgeErrors removes every failed pattern from the error cache of the
+// Compiler, so that the next attempt to compile one parses it again.
+func (c *Compiler) PurgeErrors() {
+	if c.failures != nil {
+		c.failures.Purge()
+	}
+}
+
+// Len returns the number of patterns in the cache of the Compiler.
+func (c *Compiler) Len() int {
+	if cache := c.cache.Load(); cache != nil {
+		return cache.Len()
+	}
+	return 0
+}
+
+// SetCacheSize replaces the cache of the Compiler with an empty one holding
+// up to size patterns. Compilations in progress finish against the cache
+// they started with. A negative size disables caching.
+func (c *Compiler) SetCacheSize(size int) error {
+	if size == 0 {
+		return fmt.Errorf("cache size must not be zero")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reconfigure(size, c.backend)
+}
+
+// SetCacheBackend replaces the cache of the Compiler with an empty one
+// created by backend, keeping its size.
+func (c *Compiler) SetCacheBackend(backend CacheFactory) error {
+	if backend == nil {
+		return fmt.Errorf("cache backend must not be nil")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size := -1
+	if cache := c.cache.Load(); cache != nil {
+		size = cache.size
+	}
+	return c.reconfigure(size, backend)
+}
+
+// reconfigure installs an empty cache of the given size made by backend, or
+// disables caching if size is negative. The caller holds c.mu, except
+// during construction.
+func (c *Compiler) reconfigure(size int, backend CacheFactory) error {
+	if backend == nil {
+		backend = NewLRUCache
+	}
+	if size < 0 {
+		c.cache.Store(nil)
+	} else if err := c.setCache(size, backend); err != nil {
+		return err
+	}
+	c.backend = backend
+	return nil
+}
+
+// setCache installs an empty cache of the given size made by backend.
+func (c *Compiler) setCache(size int, backend CacheFactory) error {
+	cache, err := backend(size, c.evicted)
+	if err != nil {
+		return err
+	}
+	c.cache.Store(&patternCache{Cache: cache, size: size})
+	return nil
+}
@@ -0,0 +1,169 @@
+package tinyrebuilder
+
+import (
+	"container/list"
+	"regexp/syntax"
+	"sync"
+	"time"
+)
+
+// Rough sizes, in bytes, of the parts of a compiled pattern, used to weigh
+// cache entries against each other.
+const (
+	costPerPatternByte = 2
+	costPerInst        = 40
+	costPerRune        = 4
+	costBase           = 512
+)
+
+// Cost returns an estimate of the memory held by r in bytes, based on the
+// length of its pattern and the number and size of the instructions of its
+// compiled program. It is meant for comparing patterns, such as a large
+// alternation of keywords with a short expression, rather than for exact
+// accounting.
+func (r *Regexp) Cost() int64 {
+	r.vm.costOnce.Do(func() {
+		expr := r.String()
+		cost := int64(costBase + costPerPatternByte*len(expr))
+		if re, err := parseMachineExpr(expr); err == nil {
+			if prog, err := syntax.Compile(re.Simplify()); err == nil {
+				for _, inst := range prog.Inst {
+					cost += costPerInst + costPerRune*int64(len(inst.Rune))
+				}
+			}
+		}
+		r.vm.cost = cost
+	})
+	return r.vm.cost
+}
+
+// NewCostCache returns a CacheFactory for caches that weigh each pattern by
+// its Cost and evict the least recently used patterns until the total is
+// within budget bytes. The size given to the factory still caps the number
+// of entries. A pattern costing more than the whole budget is not cached.
+//
+// If ttl is positive, patterns that have not been used for ttl are expired
+// as well; expirations are reported to the eviction callback like any other
+// eviction.
+func NewCostCache(budget int64, ttl time.Duration) CacheFactory {
+	return func(size int, onEvict func(CacheKey, *Regexp)) (Cache, error) {
+		return &costCache{
+			budget:  budget,
+			ttl:     ttl,
+			size:    size,
+			onEvict: onEvict,
+			order:   list.New(),
+			entries: make(map[CacheKey]*list.Element),
+		}, nil
+	}
+}
+
+// costEntry is an entry of a costCache.
+type costEntry struct {
+	key      CacheKey
+	re       *Regexp
+	cost     int64
+	lastUsed time.Time
+}
+
+// costCache keeps its entries in order of use, most recent first, so that
+// both the least recently used and the longest idle entries are at the back.
+type costCache struct {
+	mu      sync.Mutex
+	budget  int64
+	ttl     time.Duration
+	size    int
+	onEvict func(CacheKey, *Regexp)
+	order   *list.List
+	entries map[CacheKey]*list.Element
+	total   int64
+}
+
+func (c *costCache) Get(key CacheKey) (*Regexp, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	evicted := c.expire(now)
+	var re *Regexp
+	el, ok := c.entries[key]
+	if ok {
+		e := el.Value.(*costEntry)
+		e.lastUsed = now
+		c.order.MoveToFront(el)
+		re = e.re
+	}
+	c.mu.Unlock()
+	c.report(evicted)
+	return re, ok
+}
+
+func (c *costCache) Add(key CacheKey, re *Regexp) {
+	cost := re.Cost()
+	now := time.Now()
+	c.mu.Lock()
+	evicted := c.expire(now)
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	if cost <= c.budget {
+		c.entries[key] = c.order.PushFront(&costEntry{key: key, re: re, cost: cost, lastUsed: now})
+		c.total += cost
+		for c.total > c.budget || c.order.Len() > c.size {
+			evicted = append(evicted, c.remove(c.order.Back()))
+		}
+	}
+	c.mu.Unlock()
+	c.report(evicted)
+}
+
+func (c *costCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *costCache) Keys() []CacheKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]CacheKey, 0, c.order.Len())
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*costEntry).key)
+	}
+	return keys
+}
+
+// Bytes returns the total cost of the patterns in the cache.
+func (c *costCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// expire removes the entries that have been idle for longer than the TTL and
+// returns them.
+func (c *costCache) expire(now time.Time) []*costEntry {
+	if c.ttl <= 0 {
+		return nil
+	}
+	var out []*costEntry
+	for el := c.order.Back(); el != nil && now.Sub(el.Value.(*costEntry).lastUsed) > c.ttl; el = c.order.Back() {
+		out = append(out, c.remove(el))
+	}
+	return out
+}
+
+func (c *costCache) remove(el *list.Element) *costEntry {
+	e := c.order.Remove(el).(*costEntry)
+	delete(c.entries, e.key)
+	c.total -= e.cost
+	return e
+}
+
+// report passes evicted entries to the eviction callback, outside the lock.
+func (c *costCache) report(evicted []*costEntry) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, e := range evicted {
+		c.onEvict(e.key, e.re)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -32,7 +33,12 @@ func (r *RegexBuilder) Raw(s string) *RegexBuilder {
 }
 
 // Literal adds a literal string to the regular expression, escaping any special characters.
+// In byte mode each byte of s stands for itself.
 func (r *RegexBuilder) Literal(s string) *RegexBuilder {
+	if r.bytes {
+		r.writeBytes(s, true)
+		return r
+	}
 	r.builder.WriteString(regexp.QuoteMeta(s))
 	return r
 }
@@ -215,6 +221,21 @@ func (r *RegexBuilder) NotWordBoundary() *RegexBuilder {
 	return r
 }
 
+// UnicodeWordBoundary adds a word boundary that, unlike WordBoundary, treats
+// every Unicode letter, digit and combining mark as a word character, so that
+// it works for text such as "café". The boundary is enforced by the Regexp
+// methods; the standard library's *regexp.Regexp returned by Unwrap ignores it.
+func (r *RegexBuilder) UnicodeWordBoundary() *RegexBuilder {
+	r.builder.WriteString(unicodeWordBoundaryMarker)
+	return r
+}
+
+// NotUnicodeWordBoundary adds the negation of UnicodeWordBoundary.
+func (r *RegexBuilder) NotUnicodeWordBoundary() *RegexBuilder {
+	r.builder.WriteString(unicodeNoWordBoundaryMarker)
+	return r
+}
+
 // Tab adds a tab character (`\t`) to the expression.
 func (r *RegexBuilder) Tab() *RegexBuilder {
 	r.builder.WriteString(charTab)
@@ -234,37 +255,79 @@ func (r *RegexBuilder) CarriageReturn() *RegexBuilder {
 }
 
 // Quote escapes all special characters in the given string.
+// In byte mode each byte of s stands for itself.
 func (r *RegexBuilder) Quote(s string) *RegexBuilder {
-	r.builder.WriteString(regexp.QuoteMeta(s))
-	return r
+	return r.Literal(s)
 }
 
 // AnyOf creates a character set that matches any of the characters in the string.
+// In byte mode the set holds the bytes of s.
 func (r *RegexBuilder) AnyOf(s string) *RegexBuilder {
 	r.builder.WriteString("[")
-	r.builder.WriteString(s)
+	r.writeSet(s)
 	r.builder.WriteString("]")
 	return r
 }
 
 // NotAnyOf creates a negated character set that matches any character not in the string.
+// In byte mode the set holds the bytes of s.
 func (r *RegexBuilder) NotAnyOf(s string) *RegexBuilder {
 	r.builder.WriteString("[^")
-	r.builder.WriteString(s)
+	r.writeSet(s)
 	r.builder.WriteString("]")
 	return r
 }
 
 // Range creates a character range.
+// In byte mode from and to are byte values; bounds above 0xff match no byte.
 func (r *RegexBuilder) Range(from, to rune) *RegexBuilder {
 	r.builder.WriteString("[")
-	r.builder.WriteRune(from)
-	r.builder.WriteString("-")
-	r.builder.WriteRune(to)
+	if r.bytes {
+		writeHexEscape(r.builder, from)
+		r.builder.WriteString("-")
+		writeHexEscape(r.builder, to)
+	} else {
+		r.builder.WriteRune(from)
+		r.builder.WriteString("-")
+		r.builder.WriteRune(to)
+	}
 	r.builder.WriteString("]")
 	return r
 }
 
+// writeSet writes the contents of a character set. Outside byte mode s is
+// written as it is.
+func (r *RegexBuilder) writeSet(s string) {
+	if r.bytes {
+		r.writeBytes(s, false)
+	} else {
+		r.builder.WriteString(s)
+	}
+}
+
+// writeBytes writes the bytes of s for byte mode. Bytes above 0x7f are
+// written as escapes, which the machine reads as the byte of the same value;
+// ASCII bytes are written as they are, quoted if quote is set.
+func (r *RegexBuilder) writeBytes(s string, quote bool) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= utf8.RuneSelf:
+			writeHexEscape(r.builder, rune(c))
+		case quote:
+			r.builder.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		default:
+			r.builder.WriteByte(c)
+		}
+	}
+}
+
+// writeHexEscape writes c as a hexadecimal escape.
+func writeHexEscape(b *strings.Builder, c rune) {
+	b.WriteString(`\x{`)
+	b.WriteString(strconv.FormatInt(int64(c), 16))
+	b.WriteString("}")
+}
+
 // WithFlags adds flags to the expression.
 func (r *RegexBuilder) WithFlags(flags string) *RegexBuilder {
 	r.builder.WriteString("(?")
@@ -15,6 +15,8 @@ var builderPool = sync.Pool{
 // RegexBuilder is a fluent interface for building regular expressions.
 type RegexBuilder struct {
 	builder *strings.Builder
+	// bytes reports that the builder is in byte mode.
+	bytes bool
 }
 
 // New creates a new RegexBuilder from the pool.
@@ -22,6 +24,17 @@ func New() *RegexBuilder {
 	return &RegexBuilder{builder: builderPool.Get().(*strings.Builder)}
 }
 
+// NewBytes creates a new RegexBuilder in byte mode from the pool. In byte
+// mode the strings given to Literal, Quote, AnyOf and NotAnyOf are raw bytes
+// rather than UTF-8 text, and Range bounds are byte values, so patterns can
+// describe binary data and legacy 8-bit encodings. Compile the result with
+// CompileBytes to match []byte input one byte at a time.
+func NewBytes() *RegexBuilder {
+	r := New()
+	r.bytes = true
+	return r
+}
+
 // NewWithCapacity creates a new RegexBuilder with a given initial capacity.
 // Note: This does not use the pool as a specific capacity is requested.
 func NewWithCapacity(capacity int) *RegexBuilder {
@@ -38,14 +51,13 @@ func (r *RegexBuilder) Build() string {
 // Compile compiles the regular expression and returns the builder to the pool.
 func (r *RegexBuilder) Compile() (*Regexp, error) {
 	s := r.builder.String()
-	r.builder.Reset()
-	builderPool.Put(r.builder)
+	r.release()
 
 	re, err := regexp.Compile(s)
 	if err != nil {
 		return nil, err
 	}
-	return &Regexp{re: re}, nil
+	return newRegexp(re), nil
 }
 
 // MustCompile compiles the regular expression, panicking if it fails,
@@ -57,3 +69,9 @@ func (r *RegexBuilder) MustCompile() *Regexp {
 	}
 	return re
 }
+
+// release resets the builder and returns it to the pool.
+func (r *RegexBuilder) release() {
+	r.builder.Reset()
+	builderPool.Put(r.builder)
+}
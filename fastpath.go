@@ -0,0 +1,158 @@
+package tinyrebuilder
+
+import (
+	"regexp/syntax"
+	"strings"
+	"unicode/utf8"
+)
+
+// literalMatcher implements patterns that reduce to a small set of literal
+// strings, optionally anchored at the start or end of the text, without
+// running the regexp engine.
+type literalMatcher struct {
+	// lits holds the alternatives in leftmost-first preference order.
+	lits        []string
+	anchorStart bool
+	anchorEnd   bool
+	// fold reports that lits holds a single literal compared with
+	// strings.EqualFold; it is only set when both ends are anchored.
+	fold bool
+}
+
+// newLiteralMatcher returns a literalMatcher for a parsed expression, or nil
+// if the expression is not a plain literal shape.
+func newLiteralMatcher(re *syntax.Regexp) *literalMatcher {
+	m := &literalMatcher{}
+	body := re
+	if re.Op == syntax.OpConcat && len(re.Sub) > 1 {
+		subs := re.Sub
+		if subs[0].Op == syntax.OpBeginText {
+			m.anchorStart = true
+			subs = subs[1:]
+		}
+		if subs[len(subs)-1].Op == syntax.OpEndText {
+			m.anchorEnd = true
+			subs = subs[:len(subs)-1]
+		}
+		switch len(subs) {
+		case 0:
+			return nil
+		case 1:
+			body = subs[0]
+		default:
+			body = &syntax.Regexp{Op: syntax.OpConcat, Sub: subs}
+		}
+	}
+	if !plainLiteral(body) {
+		return nil
+	}
+	if body.Op == syntax.OpLiteral && body.Flags&syntax.FoldCase != 0 && m.anchorStart && m.anchorEnd {
+		if !strings.ContainsRune(string(body.Rune), utf8.RuneError) {
+			m.lits, m.fold = []string{string(body.Rune)}, true
+			return m
+		}
+	}
+	m.lits = analyzeLiterals(body).exact
+	if len(m.lits) == 0 {
+		return nil
+	}
+	for _, lit := range m.lits {
+		if lit == "" {
+			return nil
+		}
+	}
+	return m
+}
+
+// plainLiteral reports whether re consists only of literals, character classes
+// and their combinations, with no captures, assertions or unbounded repeats.
+func plainLiteral(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral, syntax.OpCharClass:
+		return true
+	case syntax.OpConcat, syntax.OpAlternate, syntax.OpQuest:
+		for _, sub := range re.Sub {
+			if !plainLiteral(sub) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// index returns the bounds of the leftmost match in s.
+func (m *literalMatcher) index(s string) (start, end int, ok bool) {
+	switch {
+	case m.fold:
+		if strings.EqualFold(s, m.lits[0]) {
+			return 0, len(s), true
+		}
+	case m.anchorStart && m.anchorEnd:
+		for _, lit := range m.lits {
+			if s == lit {
+				return 0, len(s), true
+			}
+		}
+	case m.anchorStart:
+		for _, lit := range m.lits {
+			if strings.HasPrefix(s, lit) {
+				return 0, len(lit), true
+			}
+		}
+	case m.anchorEnd:
+		// The longest suffix starts leftmost.
+		best := -1
+		for i, lit := range m.lits {
+			if strings.HasSuffix(s, lit) && (best < 0 || len(lit) > len(m.lits[best])) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			return len(s) - len(m.lits[best]), len(s), true
+		}
+	default:
+		return m.indexFrom(newLiteralScanner(s, m.lits), 0)
+	}
+	return 0, 0, false
+}
+
+// indexFrom returns the leftmost unanchored match at or after pos, breaking
+// ties between literals at the same position by preference order.
+func (m *literalMatcher) indexFrom(ls *literalScanner, pos int) (start, end int, ok bool) {
+	i := ls.index(pos)
+	if i < 0 {
+		return 0, 0, false
+	}
+	for _, lit := range m.lits {
+		if strings.HasPrefix(ls.s[i:], lit) {
+			return i, i + len(lit), true
+		}
+	}
+	return 0, 0, false
+}
+
+// allIndex returns the bounds of up to n successive non-overlapping matches
+// (all of them if n < 0).
+func (m *literalMatcher) allIndex(s string, n int) [][]int {
+	if n == 0 {
+		return nil
+	}
+	if m.anchorStart || m.anchorEnd {
+		if start, end, ok := m.index(s); ok {
+			return [][]int{{start, end}}
+		}
+		return nil
+	}
+	var out [][]int
+	ls := newLiteralScanner(s, m.lits)
+	for pos := 0; n < 0 || len(out) < n; {
+		start, end, ok := m.indexFrom(ls, pos)
+		if !ok {
+			break
+		}
+		out = append(out, []int{start, end})
+		pos = end
+	}
+	return out
+}
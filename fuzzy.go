@@ -0,0 +1,237 @@
+package tinyrebuilder
+
+import (
+	"fmt"
+	"regexp/syntax"
+)
+
+// FuzzyRegexp matches a pattern approximately, allowing up to a fixed number
+// of edits between the pattern and the text: characters inserted into the
+// text, pattern characters missing from it, and characters substituted for
+// others. Each edit costs one. A FuzzyRegexp is safe for concurrent use.
+type FuzzyRegexp struct {
+	expr     string
+	prog     *syntax.Prog
+	maxEdits int
+}
+
+// FuzzyMatch is an approximate match.
+type FuzzyMatch struct {
+	// Start and End are the byte offsets of the match in the input.
+	Start, End int
+	// Text is the matched text.
+	Text string
+	// Edits is the number of insertions, deletions and substitutions needed
+	// to turn the matched text into a string the pattern matches exactly.
+	Edits int
+}
+
+// CompileFuzzy compiles the pattern built by r for approximate matching with
+// at most maxEdits edits, and returns the builder to the pool. The matcher is
+// derived from the compiled form of the pattern, so any pattern the builder
+// can express may be matched approximately. Capturing groups are ignored.
+func CompileFuzzy(r *RegexBuilder, maxEdits int) (*FuzzyRegexp, error) {
+	expr := r.builder.String()
+	r.release()
+	if maxEdits < 0 {
+		return nil, fmt.Errorf("tinyrebuilder: negative edit budget %d", maxEdits)
+	}
+	re, err := parseMachineExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newProgram(re)
+	if err != nil {
+		return nil, err
+	}
+	return &FuzzyRegexp{expr: expr, prog: p.prog, maxEdits: maxEdits}, nil
+}
+
+// String returns the source text of the pattern.
+func (f *FuzzyRegexp) String() string {
+	return f.expr
+}
+
+// MaxEdits returns the edit budget of f.
+func (f *FuzzyRegexp) MaxEdits() int {
+	return f.maxEdits
+}
+
+// MatchString reports whether s contains a match of the pattern within the
+// edit budget.
+func (f *FuzzyRegexp) MatchString(s string) bool {
+	_, ok := f.search(s, 0, len(s), true)
+	return ok
+}
+
+// FindString returns the best match in s: the one with the fewest edits,
+// then the leftmost, then the longest. It reports false if no match is within
+// the edit budget.
+func (f *FuzzyRegexp) FindString(s string) (FuzzyMatch, bool) {
+	return f.search(s, 0, len(s), false)
+}
+
+// FindAllString returns non-overlapping matches in s in the order they occur:
+// the best match, as chosen by FindString, and then the best matches of the
+// text on either side of it, recursively. If n >= 0, at most n matches are
+// returned.
+func (f *FuzzyRegexp) FindAllString(s string, n int) []FuzzyMatch {
+	var out []FuzzyMatch
+	f.findAll(s, 0, len(s), n, &out)
+	return out
+}
+
+func (f *FuzzyRegexp) findAll(s string, lo, hi, n int, out *[]FuzzyMatch) {
+	if lo >= hi || len(*out) == n {
+		return
+	}
+	m, ok := f.search(s, lo, hi, false)
+	if !ok {
+		return
+	}
+	f.findAll(s, lo, m.Start, n, out)
+	if len(*out) == n {
+		return
+	}
+	*out = append(*out, m)
+	next := m.End
+	if m.End == m.Start {
+		_, width := runeAt(s, next)
+		next += max(width, 1)
+	}
+	f.findAll(s, next, hi, n, out)
+}
+
+// fuzzyState is the best way found so far to reach an instruction.
+type fuzzyState struct {
+	cost, start int
+}
+
+// fuzzyQueue is a sparse set of instructions with their best states.
+type fuzzyQueue struct {
+	sparse []uint32
+	dense  []uint32
+	states []fuzzyState
+}
+
+func newFuzzyQueue(n int) *fuzzyQueue {
+	return &fuzzyQueue{sparse: make([]uint32, n), dense: make([]uint32, 0, n), states: make([]fuzzyState, n)}
+}
+
+func (q *fuzzyQueue) contains(pc uint32) bool {
+	i := q.sparse[pc]
+	return i < uint32(len(q.dense)) && q.dense[i] == pc
+}
+
+// fuzzySearch is the state of one search for the best match in s[lo:hi].
+type fuzzySearch struct {
+	f     *FuzzyRegexp
+	best  FuzzyMatch
+	found bool
+	first bool
+}
+
+// beats reports whether a thread with the given cost and start could still
+// lead to a better match than the best one found.
+func (fs *fuzzySearch) beats(cost, start int) bool {
+	return !fs.found || cost < fs.best.Edits || cost == fs.best.Edits && start <= fs.best.Start
+}
+
+func (fs *fuzzySearch) record(cost, start, end int) {
+	b := &fs.best
+	if !fs.found || cost < b.Edits || cost == b.Edits && (start < b.Start || start == b.Start && end > b.End) {
+		fs.best = FuzzyMatch{Start: start, End: end, Edits: cost}
+		fs.found = true
+	}
+}
+
+// search returns the best match in s[lo:hi], using the text around it as
+// context for empty-width assertions. If first is set, it stops at the first
+// match found.
+//
+// The search runs the program over the text like a Pike VM, keeping for each
+// instruction only the cheapest thread, ties going to the earliest start.
+// Besides following the program, a thread may skip a rune instruction
+// (deletion), consume a rune the instruction does not accept (substitution),
+// or consume a rune without advancing (insertion), each for one edit.
+func (f *FuzzyRegexp) search(s string, lo, hi int, first bool) (FuzzyMatch, bool) {
+	fs := &fuzzySearch{f: f, first: first}
+	n := len(f.prog.Inst)
+	runq, nextq := newFuzzyQueue(n), newFuzzyQueue(n)
+	for pos := lo; ; {
+		if fs.found && (fs.first || fs.best.Edits == 0 && len(runq.dense) == 0) {
+			// No thread started from here on can do better.
+			break
+		}
+		r, width := runeAt(s, pos)
+		flag := emptyOpContext(runeBefore(s, pos), r)
+		if fs.beats(0, pos) {
+			fs.add(runq, uint32(f.prog.Start), 0, pos, pos, flag)
+		}
+		if pos >= hi {
+			break
+		}
+		nextPos := pos + width
+		r1, _ := runeAt(s, nextPos)
+		nextFlag := emptyOpContext(r, r1)
+		for _, pc := range runq.dense {
+			st := runq.states[pc]
+			if !fs.beats(st.cost, st.start) {
+				continue
+			}
+			i := &f.prog.Inst[pc]
+			switch i.Op {
+			case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+				if i.MatchRune(r) {
+					fs.add(nextq, i.Out, st.cost, st.start, nextPos, nextFlag)
+				} else {
+					fs.add(nextq, i.Out, st.cost+1, st.start, nextPos, nextFlag)
+				}
+				fs.add(nextq, pc, st.cost+1, st.start, nextPos, nextFlag)
+			}
+		}
+		runq.dense = runq.dense[:0]
+		runq, nextq = nextq, runq
+		pos = nextPos
+	}
+	if !fs.found {
+		return FuzzyMatch{}, false
+	}
+	fs.best.Text = s[fs.best.Start:fs.best.End]
+	return fs.best, true
+}
+
+// add adds a thread at pc with the given cost and start to q, following the
+// empty transitions of the program and deletions of rune instructions.
+func (fs *fuzzySearch) add(q *fuzzyQueue, pc uint32, cost, start, pos int, flag syntax.EmptyOp) {
+	if cost > fs.f.maxEdits || !fs.beats(cost, start) {
+		return
+	}
+	if q.contains(pc) {
+		old := q.states[pc]
+		if old.cost < cost || old.cost == cost && old.start <= start {
+			return
+		}
+	} else {
+		q.sparse[pc] = uint32(len(q.dense))
+		q.dense = append(q.dense, pc)
+	}
+	q.states[pc] = fuzzyState{cost: cost, start: start}
+
+	i := &fs.f.prog.Inst[pc]
+	switch i.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		fs.add(q, i.Out, cost, start, pos, flag)
+		fs.add(q, i.Arg, cost, start, pos, flag)
+	case syntax.InstCapture, syntax.InstNop:
+		fs.add(q, i.Out, cost, start, pos, flag)
+	case syntax.InstEmptyWidth:
+		if syntax.EmptyOp(i.Arg)&^flag == 0 {
+			fs.add(q, i.Out, cost, start, pos, flag)
+		}
+	case syntax.InstMatch:
+		fs.record(cost, start, pos)
+	case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+		fs.add(q, i.Out, cost+1, start, pos, flag)
+	}
+}
@@ -0,0 +1,206 @@
+package tinyrebuilder
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrInputTooLarge is returned by the context-aware methods of a Regexp when
+// the input is longer than its MaxInputSize limit.
+var ErrInputTooLarge = errors.New("tinyrebuilder: input exceeds the size limit")
+
+// Limits bound the work done by the context-aware methods of a Regexp, such
+// as MatchStringContext and FindAllStringContext. A zero field means no limit.
+type Limits struct {
+	// MaxInputSize is the length in bytes of the largest input that will be
+	// scanned. Longer inputs are rejected with ErrInputTooLarge.
+	MaxInputSize int
+	// MaxMatches is the largest number of matches a single call returns.
+	// Matches beyond it are not searched for.
+	MaxMatches int
+}
+
+// WithLimits returns a copy of r that applies limits in its context-aware
+// methods. The copy shares the compiled state of r, so it is cheap to create
+// one per tenant or per request.
+func (r *Regexp) WithLimits(limits Limits) *Regexp {
+	cp := *r
+	cp.limits = limits
+	return &cp
+}
+
+// Limits returns the limits applied by r.
+func (r *Regexp) Limits() Limits {
+	return r.limits
+}
+
+// MatchStringContext is like MatchString, but returns ctx.Err() if ctx is
+// done before the scan completes, and ErrInputTooLarge if s exceeds the
+// input limit. The context is checked between chunks of input, so a
+// cancelled scan stops promptly even on very long inputs.
+func (r *Regexp) MatchStringContext(ctx context.Context, s string) (bool, error) {
+	if err := r.checkInput(ctx, s); err != nil {
+		return false, err
+	}
+	if !r.prefilter().mayMatch(s) {
+		return false, nil
+	}
+	m := r.getMachine()
+	defer r.putMachine(m)
+	m.init(0)
+	m.ctx = ctx
+	defer func() { m.ctx = nil }()
+	matched := m.match(s, 0, false)
+	return matched, m.err
+}
+
+// FindStringSubmatchContext is like FindStringSubmatch, with the cancellation
+// and limits of MatchStringContext.
+func (r *Regexp) FindStringSubmatchContext(ctx context.Context, s string) ([]string, error) {
+	locs, err := r.findAllContext(ctx, s, 1, true)
+	if err != nil || locs == nil {
+		return nil, err
+	}
+	return submatchStrings(s, locs[0]), nil
+}
+
+// FindAllStringContext is like FindAllString, with the cancellation and limits
+// of MatchStringContext. At most MaxMatches matches are returned.
+func (r *Regexp) FindAllStringContext(ctx context.Context, s string, n int) ([]string, error) {
+	locs, err := r.findAllContext(ctx, s, n, false)
+	if err != nil || locs == nil {
+		return nil, err
+	}
+	out := make([]string, len(locs))
+	for i, loc := range locs {
+		out[i] = s[loc[0]:loc[1]]
+	}
+	return out, nil
+}
+
+// FindAllStringIndexContext is like FindAllStringIndex, with the cancellation
+// and limits of MatchStringContext. At most MaxMatches matches are returned.
+func (r *Regexp) FindAllStringIndexContext(ctx context.Context, s string, n int) ([][]int, error) {
+	return r.findAllContext(ctx, s, n, false)
+}
+
+// FindAllStringSubmatchContext is like FindAllStringSubmatch, with the
+// cancellation and limits of MatchStringContext. At most MaxMatches matches
+// are returned.
+func (r *Regexp) FindAllStringSubmatchContext(ctx context.Context, s string, n int) ([][]string, error) {
+	locs, err := r.findAllContext(ctx, s, n, true)
+	if err != nil || locs == nil {
+		return nil, err
+	}
+	out := make([][]string, len(locs))
+	for i, loc := range locs {
+		out[i] = submatchStrings(s, loc)
+	}
+	return out, nil
+}
+
+// ReplaceAllStringContext is like ReplaceAllString, with the cancellation and
+// limits of MatchStringContext. Only the first MaxMatches matches are
+// replaced.
+func (r *Regexp) ReplaceAllStringContext(ctx context.Context, s, repl string) (string, error) {
+	locs, err := r.findAllContext(ctx, s, -1, true)
+	if err != nil {
+		return "", err
+	}
+	return spliceMatches(s, locs, func(dst []byte, loc []int) []byte {
+		return r.re.ExpandString(dst, repl, s, loc)
+	}), nil
+}
+
+// checkInput reports whether s may be scanned under ctx and the input limit.
+func (r *Regexp) checkInput(ctx context.Context, s string) error {
+	if r.limits.MaxInputSize > 0 && len(s) > r.limits.MaxInputSize {
+		return ErrInputTooLarge
+	}
+	return ctx.Err()
+}
+
+// findAllContext returns the indices of up to n successive non-overlapping
+// matches (all of them if n < 0), capped by the match limit. The indices
+// include the submatches if submatches is set.
+func (r *Regexp) findAllContext(ctx context.Context, s string, n int, submatches bool) ([][]int, error) {
+	if err := r.checkInput(ctx, s); err != nil {
+		return nil, err
+	}
+	if limit := r.limits.MaxMatches; limit > 0 && (n < 0 || n > limit) {
+		n = limit
+	}
+	ncap := 2
+	if submatches {
+		ncap = r.program().ncap
+	}
+	return r.findAllMachine(ctx, s, n, ncap)
+}
+
+// matchMachine reports whether the Regexp matches s, running the machine.
+func (r *Regexp) matchMachine(s string) bool {
+	if !r.prefilter().mayMatch(s) {
+		return false
+	}
+	m := r.getMachine()
+	defer r.putMachine(m)
+	m.init(0)
+	return m.match(s, 0, false)
+}
+
+// findAllMachine returns the first ncap indices of up to n successive
+// non-overlapping matches (all of them if n < 0), running the machine and
+// checking ctx as it goes.
+func (r *Regexp) findAllMachine(ctx context.Context, s string, n, ncap int) ([][]int, error) {
+	if n == 0 || !r.prefilter().mayMatch(s) {
+		return nil, nil
+	}
+	m := r.getMachine()
+	defer r.putMachine(m)
+	m.init(ncap)
+	m.ctx = ctx
+	defer func() { m.ctx = nil }()
+	return m.findAll(s, n)
+}
+
+// findAll returns the submatch indices of up to n successive non-overlapping
+// matches in s (all of them if n < 0). It follows the standard library in
+// skipping empty matches that abut the previous match.
+func (m *machine) findAll(s string, n int) ([][]int, error) {
+	var out [][]int
+	prevEnd := -1
+	// Each call to match checks the context only once it has scanned
+	// cancelCheckInterval bytes, which short, dense matches never do, so the
+	// loop checks it as well.
+	nextCheck := cancelCheckInterval
+	for pos := 0; pos <= len(s) && (n < 0 || len(out) < n); {
+		if m.ctx != nil && pos >= nextCheck {
+			if err := m.ctx.Err(); err != nil {
+				return nil, err
+			}
+			nextCheck = pos + cancelCheckInterval
+		}
+		if !m.match(s, pos, false) {
+			if m.err != nil {
+				return nil, m.err
+			}
+			break
+		}
+		loc := m.matchcap
+		accept := true
+		if loc[1] == pos {
+			if loc[0] == prevEnd {
+				accept = false
+			}
+			_, width := m.runeAt(s, pos)
+			pos += max(width, 1)
+		} else {
+			pos = loc[1]
+		}
+		prevEnd = loc[1]
+		if accept {
+			out = append(out, append([]int(nil), loc...))
+		}
+	}
+	return out, nil
+}
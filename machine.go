@@ -0,0 +1,344 @@
+package tinyrebuilder
+
+import (
+	"context"
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// endOfText is the rune reported past either end of the input.
+const endOfText rune = -1
+
+// program is an expression compiled for the machine.
+type program struct {
+	prog      *syntax.Prog
+	startCond syntax.EmptyOp
+	// ncap is the number of submatch indices the program records.
+	ncap int
+	// longest reports that the program prefers leftmost-longest matches.
+	longest bool
+}
+
+// newProgram compiles a parsed expression for the machine.
+func newProgram(re *syntax.Regexp) (*program, error) {
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	ncap := prog.NumCap
+	if ncap > 2*markerCapBase {
+		ncap = convertBoundaryMarkers(prog)
+	}
+	return &program{prog: prog, startCond: prog.StartCond(), ncap: ncap}, nil
+}
+
+// thread is a point of execution in the machine, with its own capture state.
+type thread struct {
+	inst *syntax.Inst
+	cap  []int
+}
+
+type queueEntry struct {
+	pc uint32
+	t  *thread
+}
+
+// queue is a sparse set of threads, ordered by priority.
+type queue struct {
+	sparse []uint32
+	dense  []queueEntry
+}
+
+func newQueue(n int) queue {
+	return queue{sparse: make([]uint32, n), dense: make([]queueEntry, 0, n)}
+}
+
+func (q *queue) contains(pc uint32) bool {
+	j := q.sparse[pc]
+	return j < uint32(len(q.dense)) && q.dense[j].pc == pc
+}
+
+// machine is a Pike VM that runs a program over a string, tracking every
+// thread in lockstep. It owns all of its scratch state, so a machine that is
+// reused for many searches allocates nothing once it has warmed up.
+type machine struct {
+	p        *program
+	q0, q1   queue
+	pool     []*thread
+	matched  bool
+	matchcap []int
+	longest  bool
+	// mustEnd, if not negative, is the only position at which a match may end.
+	mustEnd int
+	// ctx, if set, is checked for cancellation every cancelCheckInterval bytes
+	// of input, and err records why a search was abandoned.
+	ctx context.Context
+	err error
+	// bytes makes the machine step over the input one byte at a time, each
+	// byte standing for the rune of the same value, instead of decoding UTF-8.
+	bytes bool
+	// visited, jobs and btcap are the scratch state of the backtracker.
+	visited []uint32
+	jobs    []backtrackJob
+	btcap   []int
+}
+
+// cancelCheckInterval is how much input a machine scans between checks of its
+// context.
+const cancelCheckInterval = 64 << 10
+
+func newMachine(p *program) *machine {
+	n := len(p.prog.Inst)
+	return &machine{
+		p:        p,
+		q0:       newQueue(n),
+		q1:       newQueue(n),
+		matchcap: make([]int, p.ncap),
+		longest:  p.longest,
+		mustEnd:  -1,
+	}
+}
+
+// init prepares the machine to record ncap submatch indices.
+func (m *machine) init(ncap int) {
+	for _, t := range m.pool {
+		t.cap = t.cap[:ncap]
+	}
+	m.matchcap = m.matchcap[:ncap]
+}
+
+func (m *machine) alloc(i *syntax.Inst) *thread {
+	var t *thread
+	if n := len(m.pool); n > 0 {
+		t = m.pool[n-1]
+		m.pool = m.pool[:n-1]
+	} else {
+		t = &thread{cap: make([]int, len(m.matchcap), cap(m.matchcap))}
+	}
+	t.inst = i
+	return t
+}
+
+func (m *machine) clear(q *queue) {
+	for _, d := range q.dense {
+		if d.t != nil {
+			m.pool = append(m.pool, d.t)
+		}
+	}
+	q.dense = q.dense[:0]
+}
+
+// runeAt decodes the rune at pos, returning endOfText past the end of s.
+func runeAt(s string, pos int) (rune, int) {
+	if pos >= len(s) {
+		return endOfText, 0
+	}
+	if c := s[pos]; c < utf8.RuneSelf {
+		return rune(c), 1
+	}
+	return utf8.DecodeRuneInString(s[pos:])
+}
+
+// runeBefore decodes the rune ending at pos, returning endOfText at the start of s.
+func runeBefore(s string, pos int) rune {
+	if pos <= 0 {
+		return endOfText
+	}
+	r, _ := utf8.DecodeLastRuneInString(s[:pos])
+	return r
+}
+
+// runeAt is like the function runeAt, but reads a single byte in byte mode.
+func (m *machine) runeAt(s string, pos int) (rune, int) {
+	if !m.bytes {
+		return runeAt(s, pos)
+	}
+	if pos >= len(s) {
+		return endOfText, 0
+	}
+	return rune(s[pos]), 1
+}
+
+// runeBefore is like the function runeBefore, but reads a single byte in byte
+// mode.
+func (m *machine) runeBefore(s string, pos int) rune {
+	if !m.bytes {
+		return runeBefore(s, pos)
+	}
+	if pos <= 0 {
+		return endOfText
+	}
+	return rune(s[pos-1])
+}
+
+// match searches s for a match beginning at or after pos, or exactly at pos
+// if anchored. The text before pos is used only as context for empty-width
+// assertions. On success the submatch indices are left in m.matchcap.
+func (m *machine) match(s string, pos int, anchored bool) bool {
+	startCond := m.p.startCond
+	if startCond == ^syntax.EmptyOp(0) {
+		return false
+	}
+	if startCond&syntax.EmptyBeginText != 0 {
+		if pos != 0 {
+			return false
+		}
+		anchored = true
+	}
+	m.matched, m.err = false, nil
+	for i := range m.matchcap {
+		m.matchcap[i] = -1
+	}
+	start := pos
+	nextCheck := pos + cancelCheckInterval
+	runq, nextq := &m.q0, &m.q1
+	r, width := m.runeAt(s, pos)
+	r1, width1 := endOfText, 0
+	if r != endOfText {
+		r1, width1 = m.runeAt(s, pos+width)
+	}
+	flag := emptyOpContext(m.runeBefore(s, pos), r)
+	for {
+		if len(runq.dense) == 0 && pos != start && (anchored || m.matched) {
+			break
+		}
+		if !m.matched && (pos == start || !anchored) {
+			if len(m.matchcap) > 0 {
+				m.matchcap[0] = pos
+			}
+			m.add(runq, uint32(m.p.prog.Start), pos, m.matchcap, flag, nil)
+		}
+		flag = emptyOpContext(r, r1)
+		m.step(runq, nextq, pos, pos+width, r, flag)
+		if width == 0 || pos == m.mustEnd {
+			break
+		}
+		if len(m.matchcap) == 0 && m.matched {
+			// Only a yes/no answer was wanted.
+			break
+		}
+		pos += width
+		if m.ctx != nil && pos >= nextCheck {
+			if m.err = m.ctx.Err(); m.err != nil {
+				m.matched = false
+				break
+			}
+			nextCheck = pos + cancelCheckInterval
+		}
+		r, width = r1, width1
+		if r != endOfText {
+			r1, width1 = m.runeAt(s, pos+width)
+		}
+		runq, nextq = nextq, runq
+	}
+	m.clear(runq)
+	m.clear(nextq)
+	return m.matched
+}
+
+// step executes one step of the machine, advancing the threads in runq over
+// the rune c and adding the survivors to nextq.
+func (m *machine) step(runq, nextq *queue, pos, nextPos int, c rune, nextCond syntax.EmptyOp) {
+	for j := 0; j < len(runq.dense); j++ {
+		d := &runq.dense[j]
+		t := d.t
+		if t == nil {
+			continue
+		}
+		if m.longest && m.matched && len(t.cap) > 0 && m.matchcap[0] < t.cap[0] {
+			m.pool = append(m.pool, t)
+			continue
+		}
+		i := t.inst
+		add := false
+		switch i.Op {
+		case syntax.InstMatch:
+			if m.mustEnd >= 0 && pos != m.mustEnd {
+				break
+			}
+			if len(t.cap) > 0 && (!m.longest || !m.matched || m.matchcap[1] < pos) {
+				t.cap[1] = pos
+				copy(m.matchcap, t.cap)
+			}
+			if !m.longest {
+				// Leftmost-first: lower-priority threads can no longer win.
+				for _, d := range runq.dense[j+1:] {
+					if d.t != nil {
+						m.pool = append(m.pool, d.t)
+					}
+				}
+				runq.dense = runq.dense[:0]
+			}
+			m.matched = true
+		case syntax.InstRune:
+			add = i.MatchRune(c)
+		case syntax.InstRune1:
+			add = c == i.Rune[0]
+		case syntax.InstRuneAny:
+			add = true
+		case syntax.InstRuneAnyNotNL:
+			add = c != '\n'
+		}
+		if add {
+			t = m.add(nextq, i.Out, nextPos, t.cap, nextCond, t)
+		}
+		if t != nil {
+			m.pool = append(m.pool, t)
+		}
+	}
+	runq.dense = runq.dense[:0]
+}
+
+// add follows the empty transitions from pc, adding the threads that reach
+// rune-consuming or matching instructions to q. It returns t if t was not
+// used to hold a new thread.
+func (m *machine) add(q *queue, pc uint32, pos int, cap []int, cond syntax.EmptyOp, t *thread) *thread {
+	for {
+		if pc == 0 || q.contains(pc) {
+			return t
+		}
+		j := len(q.dense)
+		q.dense = q.dense[:j+1]
+		d := &q.dense[j]
+		d.t = nil
+		d.pc = pc
+		q.sparse[pc] = uint32(j)
+
+		i := &m.p.prog.Inst[pc]
+		switch i.Op {
+		case syntax.InstFail:
+			return t
+		case syntax.InstAlt, syntax.InstAltMatch:
+			t = m.add(q, i.Out, pos, cap, cond, t)
+			pc = i.Arg
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(i.Arg)&^cond != 0 {
+				return t
+			}
+			pc = i.Out
+		case syntax.InstNop:
+			pc = i.Out
+		case syntax.InstCapture:
+			if int(i.Arg) >= len(cap) {
+				pc = i.Out
+				continue
+			}
+			old := cap[i.Arg]
+			cap[i.Arg] = pos
+			m.add(q, i.Out, pos, cap, cond, nil)
+			cap[i.Arg] = old
+			return t
+		default:
+			if t == nil {
+				t = m.alloc(i)
+			} else {
+				t.inst = i
+			}
+			if len(t.cap) > 0 && &t.cap[0] != &cap[0] {
+				copy(t.cap, cap)
+			}
+			d.t = t
+			return nil
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package tinyrebuilder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// manifestEntry is a pattern in a cache manifest, with the options it is
+// compiled with.
+type manifestEntry struct {
+	Pattern string `json:"pattern"`
+	Options
+}
+
+// UnmarshalJSON accepts an entry written as a bare string as well as an
+// object, so that a manifest can be a plain list of patterns.
+func (e *manifestEntry) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*e = manifestEntry{}
+		return json.Unmarshal(data, &e.Pattern)
+	}
+	type entry manifestEntry
+	return json.Unmarshal(data, (*entry)(e))
+}
+
+// readManifest parses a cache manifest: either a JSON array of patterns, as
+// written by DumpManifest, or plain text with one pattern per line. Blank
+// lines are skipped.
+func readManifest(r io.Reader) ([]manifestEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// A line-based manifest may start with a character class, so the input
+	// is only taken as JSON if it parses as such.
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' && json.Valid(trimmed) {
+		var entries []manifestEntry
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("tinyrebuilder: invalid manifest: %w", err)
+		}
+		return entries, nil
+	}
+	var entries []manifestEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" {
+			entries = append(entries, manifestEntry{Pattern: line})
+		}
+	}
+	return entries, nil
+}
+
+// Warm reads a manifest of patterns from r and compiles them into the cache
+// of the Compiler, in parallel. The manifest is either a JSON array, as
+// written by DumpManifest, whose elements are patterns or objects such as
+//
+//	{"pattern": "^[a-z]+$", "flags": "i"}
+//
+// or plain text with one pattern per line. Only as many patterns as the
+// cache holds are compiled, starting from the first, and the first pattern
+// ends up as the most recently used.
+//
+// Patterns that fail to compile are skipped; Warm compiles the others and
+// returns the failures together, each naming its position in the manifest.
+func (c *Compiler) Warm(r io.Reader) error {
+	entries, err := readManifest(r)
+	if err != nil {
+		return err
+	}
+	if cache := c.cache.Load(); cache != nil && len(entries) > cache.size {
+		entries = entries[:cache.size]
+	}
+	// The keys are those the cache stores the patterns under, so that they
+	// can be touched below.
+	keys := make([]CacheKey, len(entries))
+	checks := make([]bool, len(entries))
+	errs := make([]error, len(entries))
+	for i, e := range entries {
+		opts, err := e.Options.normalize()
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		keys[i], checks[i] = c.cacheKey(CacheKey{Pattern: e.Pattern, Options: opts})
+	}
+
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := min(runtime.GOMAXPROCS(0), len(entries)); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				_, errs[i] = c.compileKey(keys[i], checks[i])
+			}
+		}()
+	}
+	for i := range entries {
+		if errs[i] == nil {
+			next <- i
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	// Touch the patterns from last to first, so that the cache ranks them
+	// in the order of the manifest.
+	if cache := c.cache.Load(); cache != nil {
+		for i := len(keys) - 1; i >= 0; i-- {
+			if errs[i] == nil {
+				cache.Get(keys[i])
+			}
+		}
+	}
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = fmt.Errorf("tinyrebuilder: manifest entry %d: %w", i+1, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DumpManifest writes the patterns in the cache of the Compiler to w as a
+// JSON manifest that Warm can read, from the most to the least recently
+// used. Capturing the manifest of a running program and warming a new one
+// with it spares the new one the compilations of its working set. The cache
+// backend must be able to list its keys; see Cache.
+func (c *Compiler) DumpManifest(w io.Writer) error {
+	var keys []CacheKey
+	if cache := c.cache.Load(); cache != nil {
+		lister, ok := cache.Cache.(interface{ Keys() []CacheKey })
+		if !ok {
+			return fmt.Errorf("tinyrebuilder: cache backend %T cannot list its patterns", cache.Cache)
+		}
+		keys = lister.Keys()
+	}
+	entries := make([]manifestEntry, len(keys))
+	for i, k := range keys {
+		entries[i] = manifestEntry{Pattern: k.Pattern, Options: k.Options}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
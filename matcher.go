@@ -0,0 +1,125 @@
+package tinyrebuilder
+
+import "sync"
+
+// vmState holds the machine programs of a Regexp, compiled on first use, a
+// pool of machines ready to run the main program, and the memory estimate
+// of the Regexp.
+type vmState struct {
+	once     sync.Once
+	prog     *program
+	machines sync.Pool
+
+	treeOnce sync.Once
+	tree     *treeProgram
+
+	costOnce sync.Once
+	cost     int64
+}
+
+// program returns the machine program for r, compiling it on first use.
+func (r *Regexp) program() *program {
+	r.vm.once.Do(func() {
+		tree, err := parseMachineExpr(r.String())
+		if err != nil {
+			// The pattern was already accepted by regexp.Compile.
+			panic(err)
+		}
+		if r.vm.prog, err = newProgram(tree); err != nil {
+			panic(err)
+		}
+		r.vm.prog.longest = r.longest
+	})
+	return r.vm.prog
+}
+
+// getMachine returns a machine for r from its pool.
+func (r *Regexp) getMachine() *machine {
+	if m, ok := r.vm.machines.Get().(*machine); ok {
+		return m
+	}
+	return newMachine(r.program())
+}
+
+func (r *Regexp) putMachine(m *machine) {
+	r.vm.machines.Put(m)
+}
+
+// FindSubmatchIndexInto is like FindStringSubmatchIndex of the standard
+// library, but appends the submatch indices to dst[:0] instead of allocating
+// a new slice. It returns nil if there is no match. When dst has room for
+// 2*(NumSubexp()+1) indices, the call does not allocate. Like the standard
+// library, it backtracks over short inputs with small programs and runs the
+// machine otherwise.
+func (r *Regexp) FindSubmatchIndexInto(dst []int, s string) []int {
+	return r.findSubmatchIndexWith(nil, dst, s)
+}
+
+// Matcher holds the scratch state needed to match a Regexp, so that repeated
+// matching with captures allocates nothing. A Matcher is not safe for
+// concurrent use; create one per goroutine.
+type Matcher struct {
+	re  *Regexp
+	m   *machine
+	loc []int
+}
+
+// NewMatcher returns a Matcher for r.
+func (r *Regexp) NewMatcher() *Matcher {
+	p := r.program()
+	return &Matcher{re: r, m: newMachine(p), loc: make([]int, 0, p.ncap)}
+}
+
+// MatchString reports whether the Regexp matches s.
+func (m *Matcher) MatchString(s string) bool {
+	f := m.re.analyze()
+	if f.lit != nil {
+		_, _, ok := f.lit.index(s)
+		return ok
+	}
+	if !f.pre.mayMatch(s) {
+		return false
+	}
+	m.m.init(0)
+	return m.m.match(s, 0, false)
+}
+
+// FindSubmatchIndex returns the submatch indices of the leftmost match in s,
+// or nil if there is none. The returned slice is owned by the Matcher and is
+// only valid until its next use.
+func (m *Matcher) FindSubmatchIndex(s string) []int {
+	loc := m.re.findSubmatchIndexWith(m.m, m.loc, s)
+	if loc != nil {
+		m.loc = loc
+	}
+	return loc
+}
+
+// findSubmatchIndexWith runs the leftmost search for s on machine m, or on a
+// pooled machine if m is nil, appending the submatch indices to dst[:0].
+func (r *Regexp) findSubmatchIndexWith(m *machine, dst []int, s string) []int {
+	f := r.analyze()
+	if f.lit != nil {
+		start, end, ok := f.lit.index(s)
+		if !ok {
+			return nil
+		}
+		return append(dst[:0], start, end)
+	}
+	if !f.pre.mayMatch(s) {
+		return nil
+	}
+	if m == nil {
+		m = r.getMachine()
+		defer r.putMachine(m)
+	}
+	m.init(r.program().ncap)
+	if m.canBacktrack(s) {
+		if !m.backtrack(s, 0) {
+			return nil
+		}
+	} else if !m.match(s, 0, false) {
+		return nil
+	}
+	return append(dst[:0], m.matchcap...)
+}
@@ -0,0 +1,216 @@
+package tinyrebuilder
+
+import (
+	"regexp/syntax"
+	"sort"
+)
+
+// ReplaceRule pairs a pattern with its replacement in a MultiReplacer. Create
+// rules with LiteralRule, TemplateRule or FuncRule, which compile the pattern
+// as RegexBuilder.Compile does and return its builder to the pool, so a rule
+// can be given to several MultiReplacers.
+type ReplaceRule struct {
+	re       *Regexp
+	err      error
+	literal  string
+	template string
+	funcs    TemplateFuncs
+	fn       func(string) string
+	isTmpl   bool
+	priority int
+}
+
+// LiteralRule replaces matches of pattern with repl, substituted directly.
+func LiteralRule(pattern *RegexBuilder, repl string) ReplaceRule {
+	re, err := pattern.Compile()
+	return ReplaceRule{re: re, err: err, literal: repl}
+}
+
+// TemplateRule replaces matches of pattern with a Replacer template, which
+// refers to the groups of pattern. funcs may be nil.
+func TemplateRule(pattern *RegexBuilder, template string, funcs TemplateFuncs) ReplaceRule {
+	re, err := pattern.Compile()
+	return ReplaceRule{re: re, err: err, template: template, funcs: funcs, isTmpl: true}
+}
+
+// FuncRule replaces matches of pattern with the result of fn applied to the
+// matched text.
+func FuncRule(pattern *RegexBuilder, fn func(string) string) ReplaceRule {
+	re, err := pattern.Compile()
+	return ReplaceRule{re: re, err: err, fn: fn}
+}
+
+// WithPriority returns a copy of the rule with the given priority. When the
+// matches of several rules start at the same position, the rule with the
+// highest priority wins; rules of equal priority are tried in the order they
+// were given.
+func (rule ReplaceRule) WithPriority(priority int) ReplaceRule {
+	rule.priority = priority
+	return rule
+}
+
+// MultiReplacer applies many regex replacements in a single pass over the
+// input. Like strings.Replacer, it finds the leftmost match among all rules,
+// replaces it and continues after it, so replaced text is never re-scanned.
+// A MultiReplacer is safe for concurrent use.
+type MultiReplacer struct {
+	rules []multiRule
+}
+
+// multiRule is a rule with its compiled expression.
+type multiRule struct {
+	re   *Regexp
+	rule ReplaceRule
+	tmpl *Replacer
+	// contextFree reports that the expression has no empty-width assertions,
+	// so it can be searched for in a suffix of the input without the text
+	// before it.
+	contextFree bool
+}
+
+// NewMultiReplacer combines the rules, returning the error of the first rule
+// whose pattern failed to compile. The result matches as the alternation
+// of the rules would, ordered by priority, but each rule keeps its own literal
+// fast path or prefilter.
+func NewMultiReplacer(rules ...ReplaceRule) (*MultiReplacer, error) {
+	ordered := make([]ReplaceRule, len(rules))
+	copy(ordered, rules)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].priority > ordered[j].priority
+	})
+
+	mr := &MultiReplacer{rules: make([]multiRule, 0, len(ordered))}
+	for _, rule := range ordered {
+		if rule.err != nil {
+			return nil, rule.err
+		}
+		tree, err := parseMachineExpr(rule.re.String())
+		if err != nil {
+			return nil, err
+		}
+		mrule := multiRule{re: rule.re, rule: rule, contextFree: !hasAssertion(tree)}
+		if rule.isTmpl {
+			if mrule.tmpl, err = mrule.re.NewReplacer(rule.template, rule.funcs); err != nil {
+				return nil, err
+			}
+		}
+		mr.rules = append(mr.rules, mrule)
+	}
+	return mr, nil
+}
+
+// hasAssertion reports whether re contains an empty-width assertion.
+func hasAssertion(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return true
+	case syntax.OpCapture:
+		if re.Cap >= markerCapBase {
+			return true
+		}
+	}
+	for _, sub := range re.Sub {
+		if hasAssertion(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// find appends to dst[:0] the submatch indices of the leftmost match of the
+// rule that begins at or after pos in s, or returns nil if there is none.
+func (rule *multiRule) find(dst []int, s string, pos int) []int {
+	if rule.contextFree {
+		loc := rule.re.findSubmatchIndexWith(nil, dst, s[pos:])
+		for i := range loc {
+			if loc[i] >= 0 {
+				loc[i] += pos
+			}
+		}
+		return loc
+	}
+	if !rule.re.prefilter().mayMatch(s[pos:]) {
+		return nil
+	}
+	m := rule.re.getMachine()
+	defer rule.re.putMachine(m)
+	m.init(rule.re.program().ncap)
+	if !m.match(s, pos, false) {
+		return nil
+	}
+	return append(dst[:0], m.matchcap...)
+}
+
+// Replace returns a copy of s with every match of any rule replaced.
+//
+// The next match of each rule is remembered between steps: a rule is searched
+// again only once the scan has moved past the start of its remembered match,
+// so each rule scans the input about once.
+func (mr *MultiReplacer) Replace(s string) string {
+	next := make([][]int, len(mr.rules))
+	done := make([]bool, len(mr.rules))
+	var buf []byte
+	replaced := false
+	last, prevEnd := 0, -1
+	for pos := 0; pos <= len(s); {
+		best := -1
+		for i := range mr.rules {
+			if done[i] {
+				continue
+			}
+			if next[i] == nil || next[i][0] < pos {
+				if next[i] = mr.rules[i].find(next[i], s, pos); next[i] == nil {
+					done[i] = true
+					continue
+				}
+			}
+			if best < 0 || next[i][0] < next[best][0] {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		loc := next[best]
+		// As in the standard library, an empty match right after the previous
+		// match is skipped, and the scan steps over a rune after an empty match.
+		accept := true
+		if loc[1] == pos {
+			if loc[0] == prevEnd {
+				accept = false
+			}
+			if pos == len(s) {
+				pos++
+			} else {
+				_, width := runeAt(s, pos)
+				pos += width
+			}
+		} else {
+			pos = loc[1]
+		}
+		prevEnd = loc[1]
+		if accept {
+			buf = append(buf, s[last:loc[0]]...)
+			buf = mr.rules[best].replace(buf, s, loc)
+			last, replaced = loc[1], true
+		}
+	}
+	if !replaced {
+		return s
+	}
+	buf = append(buf, s[last:]...)
+	return string(buf)
+}
+
+// replace appends the replacement for the match loc of the rule to dst.
+func (rule *multiRule) replace(dst []byte, s string, loc []int) []byte {
+	switch {
+	case rule.tmpl != nil:
+		return rule.tmpl.expand(dst, s, loc)
+	case rule.rule.fn != nil:
+		return append(dst, rule.rule.fn(s[loc[0]:loc[1]])...)
+	default:
+		return append(dst, rule.rule.literal...)
+	}
+}
@@ -0,0 +1,113 @@
+package tinyrebuilder
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// Options select how a pattern is compiled. The zero value compiles as
+// Compile does: Perl syntax, leftmost-first matching and every optimization.
+type Options struct {
+	// POSIX restricts the pattern to POSIX ERE (egrep) syntax and selects
+	// leftmost-longest matching, as regexp.CompilePOSIX does.
+	POSIX bool `json:"posix,omitempty"`
+	// Longest selects leftmost-longest matching, as Regexp.Longest does in
+	// the standard library.
+	Longest bool `json:"longest,omitempty"`
+	// NoOptimize disables the literal fast paths and prefilters, so that
+	// every search runs on the underlying engine. Results are unchanged.
+	NoOptimize bool `json:"noOptimize,omitempty"`
+	// Flags are applied to the whole pattern, as by WithFlags at its start:
+	// any of "i", "m", "s" and "U".
+	Flags string `json:"flags,omitempty"`
+}
+
+// normalize returns the canonical form of o, in which options that have the
+// same effect are spelled the same way, so that it can serve in cache keys.
+func (o Options) normalize() (Options, error) {
+	flags := []byte(o.Flags)
+	for _, c := range flags {
+		if !strings.ContainsRune("imsU", rune(c)) {
+			return Options{}, fmt.Errorf("tinyrebuilder: unknown flag %q in Options.Flags", c)
+		}
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i] < flags[j] })
+	n := 0
+	for i, c := range flags {
+		if i == 0 || c != flags[i-1] {
+			flags[n] = c
+			n++
+		}
+	}
+	o.Flags = string(flags[:n])
+	if o.POSIX {
+		o.Longest = true
+	}
+	return o, nil
+}
+
+// syntaxFlags returns the parser flags selected by o.
+func (o Options) syntaxFlags() syntax.Flags {
+	flags := syntax.Perl
+	if o.POSIX {
+		flags = syntax.POSIX
+	}
+	for _, c := range o.Flags {
+		switch c {
+		case 'i':
+			flags |= syntax.FoldCase
+		case 'm':
+			flags &^= syntax.OneLine
+		case 's':
+			flags |= syntax.DotNL
+		case 'U':
+			flags |= syntax.NonGreedy
+		}
+	}
+	return flags
+}
+
+// expr returns pattern rewritten in Perl syntax with the flags of o applied,
+// so that the standard library and the machine parse it the same way.
+func (o Options) expr(pattern string) (string, error) {
+	if !o.POSIX && o.Flags == "" {
+		return pattern, nil
+	}
+	re, err := syntax.Parse(pattern, o.syntaxFlags())
+	if err != nil {
+		return "", err
+	}
+	return re.String(), nil
+}
+
+// CompileWithOptions compiles the regular expression with the given options
+// and returns the builder to the pool. When POSIX or Flags is set, the
+// String method of the result returns the pattern rewritten in Perl syntax.
+func (r *RegexBuilder) CompileWithOptions(opts Options) (*Regexp, error) {
+	pattern := r.Build()
+	r.release()
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return compileOptions(pattern, opts)
+}
+
+// compileOptions compiles pattern with normalized options.
+func compileOptions(pattern string, opts Options) (*Regexp, error) {
+	expr, err := opts.expr(pattern)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Longest {
+		re.Longest()
+	}
+	return newRegexpOptions(re, opts), nil
+}
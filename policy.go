@@ -0,0 +1,273 @@
+package tinyrebuilder
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+)
+
+// CompilePolicy describes the patterns CompileUntrusted accepts. A zero limit
+// means the corresponding property is not checked.
+type CompilePolicy struct {
+	// MaxPatternLength is the longest pattern, in bytes, that will be parsed.
+	MaxPatternLength int
+	// MaxRepeat is the largest count allowed in a counted repetition such as
+	// x{2,50}.
+	MaxRepeat int
+	// MaxNestingDepth is the deepest nesting of groups and repetitions.
+	MaxNestingDepth int
+	// MaxCaptureGroups is the largest number of capturing groups.
+	MaxCaptureGroups int
+	// MaxProgramSize is the largest number of instructions in the compiled
+	// program, which bounds the memory and time spent per input byte.
+	MaxProgramSize int
+
+	// RestrictFlags limits the flags set with (?flags) or (?flags:re) to those
+	// listed in AllowedFlags, for example "i" or "ims".
+	RestrictFlags bool
+	AllowedFlags  string
+
+	// ForbidAnyByte rejects \C, which matches a single byte regardless of
+	// encoding. The standard library rejects it as well; the policy reports it
+	// alongside the other violations.
+	ForbidAnyByte bool
+	// ForbidLeadingWildcard rejects patterns that begin with an unbounded
+	// wildcard such as .* or .+, which make every position of the input a
+	// potential match start.
+	ForbidLeadingWildcard bool
+}
+
+// DefaultUntrustedPolicy is a conservative policy for patterns supplied by
+// users.
+var DefaultUntrustedPolicy = CompilePolicy{
+	MaxPatternLength:      1024,
+	MaxRepeat:             100,
+	MaxNestingDepth:       10,
+	MaxCaptureGroups:      20,
+	MaxProgramSize:        5000,
+	RestrictFlags:         true,
+	AllowedFlags:          "imsU",
+	ForbidAnyByte:         true,
+	ForbidLeadingWildcard: true,
+}
+
+// PolicyViolation describes one way in which a pattern breaks a CompilePolicy.
+type PolicyViolation struct {
+	// Rule is the name of the policy field that was violated, or "Syntax" if
+	// the pattern could not be parsed.
+	Rule string
+	// Message describes the violation.
+	Message string
+}
+
+func (v PolicyViolation) String() string {
+	return v.Rule + ": " + v.Message
+}
+
+// PolicyError is returned by CompileUntrusted for a pattern that breaks the
+// policy. It lists every violation found.
+type PolicyError struct {
+	Pattern    string
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.String()
+	}
+	return fmt.Sprintf("tinyrebuilder: pattern %q violates the compile policy: %s", e.Pattern, strings.Join(msgs, "; "))
+}
+
+// CompileUntrusted checks the pattern built by r against policy and compiles
+// it only if there are no violations. Otherwise it returns a *PolicyError. As
+// with Compile, the builder is returned to the pool.
+func CompileUntrusted(r *RegexBuilder, policy CompilePolicy) (*Regexp, error) {
+	pattern := r.Build()
+	if violations := policy.Check(pattern); len(violations) > 0 {
+		r.release()
+		return nil, &PolicyError{Pattern: pattern, Violations: violations}
+	}
+	return r.Compile()
+}
+
+// Check returns every violation of the policy by pattern, or nil if it
+// complies. A pattern that is too long is not examined further.
+func (p CompilePolicy) Check(pattern string) []PolicyViolation {
+	if p.MaxPatternLength > 0 && len(pattern) > p.MaxPatternLength {
+		return []PolicyViolation{{"MaxPatternLength", fmt.Sprintf("pattern is %d bytes long; the limit is %d", len(pattern), p.MaxPatternLength)}}
+	}
+	var out []PolicyViolation
+	add := func(rule, format string, args ...any) {
+		out = append(out, PolicyViolation{rule, fmt.Sprintf(format, args...)})
+	}
+
+	p.checkText(pattern, add)
+
+	// The Unicode word boundary markers of the builder are parsed as the
+	// empty groups they are written as, renumbered out of the way of the
+	// real groups, so that they are neither counted nor mistaken for text.
+	re, err := parseMachineExpr(pattern)
+	if err != nil {
+		// \C is already reported as a forbidden construct.
+		if e, ok := err.(*syntax.Error); !p.ForbidAnyByte || !ok || e.Code != syntax.ErrInvalidEscape || e.Expr != `\C` {
+			add("Syntax", "%v", err)
+		}
+		return out
+	}
+
+	if depth := nestingDepth(re); p.MaxNestingDepth > 0 && depth > p.MaxNestingDepth {
+		add("MaxNestingDepth", "groups and repetitions are nested %d deep; the limit is %d", depth, p.MaxNestingDepth)
+	}
+	if p.MaxRepeat > 0 {
+		if n := maxRepeat(re); n > p.MaxRepeat {
+			add("MaxRepeat", "repetition count %d exceeds the limit of %d", n, p.MaxRepeat)
+		}
+	}
+	if n := captureGroups(re); p.MaxCaptureGroups > 0 && n > p.MaxCaptureGroups {
+		add("MaxCaptureGroups", "pattern has %d capturing groups; the limit is %d", n, p.MaxCaptureGroups)
+	}
+	if p.ForbidLeadingWildcard && leadingWildcard(re) {
+		add("ForbidLeadingWildcard", "pattern begins with an unbounded wildcard")
+	}
+	if p.MaxProgramSize > 0 {
+		prog, err := syntax.Compile(re.Simplify())
+		if err != nil {
+			add("Syntax", "%v", err)
+		} else if n := len(prog.Inst); n > p.MaxProgramSize {
+			add("MaxProgramSize", "compiled program has %d instructions; the limit is %d", n, p.MaxProgramSize)
+		}
+	}
+	return out
+}
+
+// checkText scans the pattern text for the flags it sets and for \C, which
+// the parser does not preserve.
+func (p CompilePolicy) checkText(pattern string, add func(rule, format string, args ...any)) {
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			switch pattern[i+1] {
+			case 'C':
+				if p.ForbidAnyByte {
+					add("ForbidAnyByte", `\C at offset %d is not allowed`, i)
+				}
+			case 'Q':
+				// Everything up to \E is literal.
+				if end := strings.Index(pattern[i+2:], `\E`); end >= 0 {
+					i += end + 3
+					continue
+				}
+				return
+			}
+			i++
+		case inClass:
+			if strings.HasPrefix(pattern[i:], "[:") {
+				if end := strings.Index(pattern[i+2:], ":]"); end >= 0 {
+					i += end + 3
+				}
+			} else if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+			// A ] right after the opening bracket is literal.
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+			}
+		case c == '(' && strings.HasPrefix(pattern[i:], "(?"):
+			j := i + 2
+			for j < len(pattern) && strings.IndexByte("imsU-", pattern[j]) >= 0 {
+				j++
+			}
+			if !p.RestrictFlags || j == i+2 || j == len(pattern) || pattern[j] != ')' && pattern[j] != ':' {
+				continue
+			}
+			for _, f := range pattern[i+2 : j] {
+				if f != '-' && !strings.ContainsRune(p.AllowedFlags, f) {
+					add("AllowedFlags", "flag %q at offset %d is not allowed", f, i)
+				}
+			}
+		}
+	}
+}
+
+// isMarker reports whether re is a Unicode word boundary marker, as parsed by
+// parseMachineExpr.
+func isMarker(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpCapture && re.Cap >= markerCapBase
+}
+
+// captureGroups returns the number of capturing groups in re, not counting
+// boundary markers.
+func captureGroups(re *syntax.Regexp) int {
+	n := 0
+	if re.Op == syntax.OpCapture && !isMarker(re) {
+		n = re.Cap
+	}
+	for _, sub := range re.Sub {
+		n = max(n, captureGroups(sub))
+	}
+	return n
+}
+
+// nestingDepth returns the deepest nesting of groups and repetitions in re.
+func nestingDepth(re *syntax.Regexp) int {
+	if isMarker(re) {
+		return 0
+	}
+	depth := 0
+	for _, sub := range re.Sub {
+		depth = max(depth, nestingDepth(sub))
+	}
+	switch re.Op {
+	case syntax.OpCapture, syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		depth++
+	}
+	return depth
+}
+
+// maxRepeat returns the largest count in a counted repetition in re.
+func maxRepeat(re *syntax.Regexp) int {
+	n := 0
+	if re.Op == syntax.OpRepeat {
+		n = max(re.Min, re.Max)
+	}
+	for _, sub := range re.Sub {
+		n = max(n, maxRepeat(sub))
+	}
+	return n
+}
+
+// leadingWildcard reports whether a match of re may begin with an unbounded
+// repetition of any character.
+func leadingWildcard(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		return re.Sub[0].Op == syntax.OpAnyChar || re.Sub[0].Op == syntax.OpAnyCharNotNL
+	case syntax.OpRepeat:
+		return re.Max < 0 && (re.Sub[0].Op == syntax.OpAnyChar || re.Sub[0].Op == syntax.OpAnyCharNotNL)
+	case syntax.OpCapture:
+		return leadingWildcard(re.Sub[0])
+	case syntax.OpConcat:
+		// Boundary markers match the empty string, so the wildcard may
+		// follow them.
+		subs := re.Sub
+		for len(subs) > 0 && isMarker(subs[0]) {
+			subs = subs[1:]
+		}
+		return len(subs) > 0 && leadingWildcard(subs[0])
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if leadingWildcard(sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
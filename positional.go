@@ -0,0 +1,146 @@
+package tinyrebuilder
+
+import (
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// MatchAt reports whether a match of the Regexp begins exactly at byte offset
+// pos of s. The text before pos is taken into account for anchors and word
+// boundaries. It returns false if pos is out of range or falls inside a
+// multibyte rune.
+func (r *Regexp) MatchAt(s string, pos int) bool {
+	if pos < 0 || pos > len(s) || !runeBoundary(s, pos) || !r.prefilter().mayMatch(s) {
+		return false
+	}
+	m := r.getMachine()
+	defer r.putMachine(m)
+	m.init(0)
+	return m.match(s, pos, true)
+}
+
+// FindAllOverlapping returns the bounds of the match starting at every rune
+// boundary of s where one exists, including matches that overlap earlier
+// ones. At each position the match is the one the leftmost-first search would
+// report. If n >= 0, at most n matches are returned.
+func (r *Regexp) FindAllOverlapping(s string, n int) [][]int {
+	if n == 0 || !r.prefilter().mayMatch(s) {
+		return nil
+	}
+	m := r.getMachine()
+	defer r.putMachine(m)
+	m.init(2)
+	var out [][]int
+	for pos := 0; pos <= len(s); {
+		if m.match(s, pos, true) {
+			out = append(out, []int{m.matchcap[0], m.matchcap[1]})
+			if len(out) == n {
+				break
+			}
+		}
+		if pos == len(s) {
+			break
+		}
+		_, width := runeAt(s, pos)
+		pos += width
+	}
+	return out
+}
+
+// FindLast returns the bounds of the match that starts at the rightmost
+// position of s, or nil if there is no match. It agrees with the last element
+// of FindAllOverlapping, but scans s only twice: once to find where the last
+// match starts, and once to find where it ends.
+func (r *Regexp) FindLast(s string) []int {
+	if !r.prefilter().mayMatch(s) {
+		return nil
+	}
+	m := r.getMachine()
+	defer r.putMachine(m)
+	m.init(2)
+	pos := m.lastStart(s)
+	if pos < 0 || !m.match(s, pos, true) {
+		return nil
+	}
+	return []int{m.matchcap[0], m.matchcap[1]}
+}
+
+// lastStart returns the rightmost position of s at which a match begins, or
+// -1 if there is none. It runs the machine over s once, starting a thread at
+// every position. A thread started later is added ahead of the threads
+// already running, so when two threads reach the same instruction the later
+// start survives: both can reach the same matches from there on, and only
+// the latest start is wanted.
+func (m *machine) lastStart(s string) int {
+	if m.p.startCond == ^syntax.EmptyOp(0) {
+		return -1
+	}
+	last := -1
+	runq, nextq := &m.q0, &m.q1
+	pos := 0
+	r, width := m.runeAt(s, pos)
+	r1, width1 := endOfText, 0
+	if r != endOfText {
+		r1, width1 = m.runeAt(s, pos+width)
+	}
+	m.matchcap[0] = pos
+	m.add(runq, uint32(m.p.prog.Start), pos, m.matchcap, emptyOpContext(endOfText, r), nil)
+	for {
+		flag := emptyOpContext(r, r1)
+		if width > 0 {
+			m.matchcap[0] = pos + width
+			m.add(nextq, uint32(m.p.prog.Start), pos+width, m.matchcap, flag, nil)
+		}
+		for _, d := range runq.dense {
+			t := d.t
+			if t == nil {
+				continue
+			}
+			i := t.inst
+			add := false
+			switch i.Op {
+			case syntax.InstMatch:
+				last = max(last, t.cap[0])
+			case syntax.InstRune:
+				add = i.MatchRune(r)
+			case syntax.InstRune1:
+				add = r == i.Rune[0]
+			case syntax.InstRuneAny:
+				add = true
+			case syntax.InstRuneAnyNotNL:
+				add = r != '\n'
+			}
+			if add {
+				t = m.add(nextq, i.Out, pos+width, t.cap, flag, t)
+			}
+			if t != nil {
+				m.pool = append(m.pool, t)
+			}
+		}
+		runq.dense = runq.dense[:0]
+		if width == 0 {
+			break
+		}
+		pos += width
+		r, width = r1, width1
+		if r != endOfText {
+			r1, width1 = m.runeAt(s, pos+width)
+		}
+		runq, nextq = nextq, runq
+	}
+	m.clear(runq)
+	m.clear(nextq)
+	return last
+}
+
+// runeBoundary reports whether the matcher, stepping through s one rune at a
+// time, stops at pos. Invalid UTF-8 is stepped over one byte at a time.
+func runeBoundary(s string, pos int) bool {
+	for q := pos - 1; q >= 0 && q > pos-utf8.UTFMax; q-- {
+		if utf8.RuneStart(s[q]) {
+			_, width := utf8.DecodeRuneInString(s[q:])
+			return q+width <= pos
+		}
+	}
+	return true
+}
@@ -0,0 +1,405 @@
+package tinyrebuilder
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxLiteralSet bounds the number of alternatives tracked for a literal set.
+	maxLiteralSet = 16
+	// maxPrefilterLiterals bounds the number of literals searched by a prefilter.
+	maxPrefilterLiterals = 8
+)
+
+// literalInfo describes the literal strings a regular expression requires.
+type literalInfo struct {
+	// exact, if non-nil, lists every string the expression can match, in the
+	// order a leftmost-first engine would prefer them.
+	exact []string
+	// must, if non-nil, lists strings of which at least one occurs in every match.
+	must []string
+}
+
+// analyzeLiterals computes the literal information of a parsed expression.
+func analyzeLiterals(re *syntax.Regexp) literalInfo {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return literalInfo{exact: []string{""}}
+	case syntax.OpLiteral:
+		return literalInfo{exact: literalVariants(re.Rune, re.Flags&syntax.FoldCase != 0)}
+	case syntax.OpCharClass:
+		return literalInfo{exact: classVariants(re.Rune)}
+	case syntax.OpCapture:
+		return analyzeLiterals(re.Sub[0])
+	case syntax.OpPlus:
+		return literalInfo{must: analyzeLiterals(re.Sub[0]).best()}
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return literalInfo{must: analyzeLiterals(re.Sub[0]).best()}
+		}
+	case syntax.OpQuest:
+		sub := analyzeLiterals(re.Sub[0])
+		if sub.exact == nil {
+			return literalInfo{}
+		}
+		if re.Flags&syntax.NonGreedy != 0 {
+			return literalInfo{exact: unionLiterals([]string{""}, sub.exact)}
+		}
+		return literalInfo{exact: unionLiterals(sub.exact, []string{""})}
+	case syntax.OpConcat:
+		return analyzeConcat(re.Sub)
+	case syntax.OpAlternate:
+		return analyzeAlternate(re.Sub)
+	}
+	return literalInfo{}
+}
+
+// analyzeConcat multiplies out the exact sets of adjacent sub-expressions,
+// keeping the best required set seen along the way.
+func analyzeConcat(subs []*syntax.Regexp) literalInfo {
+	var must []string
+	acc := []string{""}
+	exact := true
+	for _, sub := range subs {
+		info := analyzeLiterals(sub)
+		must = betterLiterals(must, info.must)
+		if info.exact != nil && len(acc)*len(info.exact) <= maxLiteralSet {
+			acc = crossLiterals(acc, info.exact)
+			continue
+		}
+		exact = false
+		must = betterLiterals(must, acc)
+		if info.exact != nil {
+			acc = info.exact
+		} else {
+			acc = []string{""}
+		}
+	}
+	if exact {
+		return literalInfo{exact: acc, must: betterLiterals(must, acc)}
+	}
+	return literalInfo{must: betterLiterals(must, acc)}
+}
+
+// analyzeAlternate unions the information of each alternative.
+func analyzeAlternate(subs []*syntax.Regexp) literalInfo {
+	var exact, must []string
+	exactOK, mustOK := true, true
+	for _, sub := range subs {
+		info := analyzeLiterals(sub)
+		if exactOK && info.exact != nil {
+			exact = unionLiterals(exact, info.exact)
+			exactOK = len(exact) <= maxLiteralSet
+		} else {
+			exactOK = false
+		}
+		if best := info.best(); mustOK && best != nil {
+			must = unionLiterals(must, best)
+		} else {
+			mustOK = false
+		}
+	}
+	var info literalInfo
+	if exactOK {
+		info.exact = exact
+	}
+	if mustOK {
+		info.must = must
+	}
+	return info
+}
+
+// best returns the most selective required set known for the expression.
+func (info literalInfo) best() []string {
+	return betterLiterals(info.must, info.exact)
+}
+
+// betterLiterals returns whichever of the two required sets is more selective,
+// preferring a when they are equally good.
+func betterLiterals(a, b []string) []string {
+	if literalScore(b) > literalScore(a) {
+		return b
+	}
+	return a
+}
+
+// literalScore rates a required set: longer shortest literals and fewer
+// alternatives make for cheaper and more selective searches.
+func literalScore(lits []string) int {
+	if len(lits) == 0 || len(lits) > maxPrefilterLiterals {
+		return 0
+	}
+	shortest := len(lits[0])
+	for _, lit := range lits[1:] {
+		shortest = min(shortest, len(lit))
+	}
+	return shortest*(maxPrefilterLiterals+1) - len(lits)
+}
+
+// literalVariants returns the strings matched by a literal, expanding its case
+// variants when it is case-insensitive. It returns nil if there are too many.
+func literalVariants(runes []rune, fold bool) []string {
+	acc := []string{""}
+	for _, r := range runes {
+		if r == utf8.RuneError {
+			// Invalid UTF-8 in the input matches U+FFFD, so the literal bytes
+			// need not appear in it.
+			return nil
+		}
+		set := []string{string(r)}
+		if fold {
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				set = append(set, string(f))
+			}
+		}
+		if len(acc)*len(set) > maxLiteralSet {
+			return nil
+		}
+		acc = crossLiterals(acc, set)
+	}
+	return acc
+}
+
+// classVariants returns the single-rune strings matched by a small character
+// class, or nil if the class is too large.
+func classVariants(ranges []rune) []string {
+	var set []string
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if int(hi-lo)+1+len(set) > maxLiteralSet || lo <= utf8.RuneError && utf8.RuneError <= hi {
+			return nil
+		}
+		for r := lo; r <= hi; r++ {
+			set = append(set, string(r))
+		}
+	}
+	return set
+}
+
+// crossLiterals returns every concatenation of a string of a with a string of b,
+// ordered by a first.
+func crossLiterals(a, b []string) []string {
+	out := make([]string, 0, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			out = unionLiterals(out, []string{x + y})
+		}
+	}
+	return out
+}
+
+// unionLiterals appends the strings of b missing from a.
+func unionLiterals(a, b []string) []string {
+	for _, s := range b {
+		dup := false
+		for _, t := range a {
+			if s == t {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			a = append(a, s)
+		}
+	}
+	return a
+}
+
+// prefilter rejects input that cannot contain a match before the regexp
+// engine runs. Every match of the expression contains one of lits.
+type prefilter struct {
+	lits []string
+	// lines reports that matches never span a newline and do not depend on the
+	// start or end of the text, so only lines containing a literal need scanning.
+	lines bool
+}
+
+// newPrefilter builds a prefilter for a parsed expression, returning nil if the
+// expression has no useful required literal.
+func newPrefilter(re *syntax.Regexp) *prefilter {
+	lits := analyzeLiterals(re).best()
+	if literalScore(lits) <= 0 {
+		return nil
+	}
+	return &prefilter{lits: lits, lines: !spansLines(re)}
+}
+
+// spansLines reports whether a match could include a newline or depends on the
+// text boundaries, which would make scanning line by line unsafe.
+func spansLines(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpAnyChar, syntax.OpBeginText, syntax.OpEndText:
+		return true
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r == '\n' {
+				return true
+			}
+		}
+	case syntax.OpCharClass:
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i] <= '\n' && '\n' <= re.Rune[i+1] {
+				return true
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		if spansLines(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayMatch reports whether s contains one of the required literals.
+// A nil prefilter accepts everything.
+func (p *prefilter) mayMatch(s string) bool {
+	if p == nil {
+		return true
+	}
+	for _, lit := range p.lits {
+		if strings.Contains(s, lit) {
+			return true
+		}
+	}
+	return false
+}
+
+// literalScanner finds successive occurrences of any of a set of literals,
+// remembering where each literal occurs next so the text is scanned once.
+type literalScanner struct {
+	s    string
+	lits []string
+	next []int
+}
+
+func newLiteralScanner(s string, lits []string) *literalScanner {
+	next := make([]int, len(lits))
+	for i, lit := range lits {
+		next[i] = strings.Index(s, lit)
+	}
+	return &literalScanner{s: s, lits: lits, next: next}
+}
+
+// index returns the position of the first occurrence of any literal at or
+// after pos, or -1 if there is none.
+func (ls *literalScanner) index(pos int) int {
+	if pos > len(ls.s) {
+		return -1
+	}
+	first := -1
+	for i, lit := range ls.lits {
+		if ls.next[i] >= 0 && ls.next[i] < pos {
+			ls.next[i] = strings.Index(ls.s[pos:], lit)
+			if ls.next[i] >= 0 {
+				ls.next[i] += pos
+			}
+		}
+		if ls.next[i] >= 0 && (first < 0 || ls.next[i] < first) {
+			first = ls.next[i]
+		}
+	}
+	return first
+}
+
+// nextLine returns the bounds of the next line at or after pos that contains
+// one of the literals.
+func (ls *literalScanner) nextLine(pos int) (start, end int, ok bool) {
+	i := ls.index(pos)
+	if i < 0 {
+		return 0, 0, false
+	}
+	start = strings.LastIndexByte(ls.s[:i], '\n') + 1
+	end = strings.IndexByte(ls.s[i:], '\n')
+	if end < 0 {
+		end = len(ls.s)
+	} else {
+		end += i
+	}
+	return start, end, true
+}
+
+// match reports whether re matches s, consulting only the lines that may
+// contain a match.
+func (p *prefilter) match(re *regexp.Regexp, s string) bool {
+	if !p.lines {
+		return p.mayMatch(s) && re.MatchString(s)
+	}
+	ls := newLiteralScanner(s, p.lits)
+	for pos := 0; ; {
+		start, end, ok := ls.nextLine(pos)
+		if !ok {
+			return false
+		}
+		if re.MatchString(s[start:end]) {
+			return true
+		}
+		pos = end + 1
+	}
+}
+
+// findIndex returns the submatch indices of the leftmost match, consulting
+// only the lines that may contain it.
+func (p *prefilter) findIndex(re *regexp.Regexp, s string) []int {
+	if !p.lines {
+		if !p.mayMatch(s) {
+			return nil
+		}
+		return re.FindStringSubmatchIndex(s)
+	}
+	ls := newLiteralScanner(s, p.lits)
+	for pos := 0; ; {
+		start, end, ok := ls.nextLine(pos)
+		if !ok {
+			return nil
+		}
+		if loc := re.FindStringSubmatchIndex(s[start:end]); loc != nil {
+			return shiftIndex(loc, start)
+		}
+		pos = end + 1
+	}
+}
+
+// findAll returns the submatch indices of up to n successive matches (all of
+// them if n < 0), consulting only the lines that may contain them.
+func (p *prefilter) findAll(re *regexp.Regexp, s string, n int) [][]int {
+	if !p.lines {
+		if !p.mayMatch(s) {
+			return nil
+		}
+		return re.FindAllStringSubmatchIndex(s, n)
+	}
+	var out [][]int
+	ls := newLiteralScanner(s, p.lits)
+	for pos := 0; n < 0 || len(out) < n; {
+		start, end, ok := ls.nextLine(pos)
+		if !ok {
+			break
+		}
+		limit := -1
+		if n >= 0 {
+			limit = n - len(out)
+		}
+		for _, loc := range re.FindAllStringSubmatchIndex(s[start:end], limit) {
+			out = append(out, shiftIndex(loc, start))
+		}
+		pos = end + 1
+	}
+	return out
+}
+
+// shiftIndex adds off to every participating index in loc.
+func shiftIndex(loc []int, off int) []int {
+	for i, v := range loc {
+		if v >= 0 {
+			loc[i] = v + off
+		}
+	}
+	return loc
+}
@@ -0,0 +1,344 @@
+package tinyrebuilder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TemplateFuncs maps function names to functions that can be applied to a
+// group in a replacement template, as in ${upper(name)}.
+type TemplateFuncs map[string]func(string) string
+
+// builtinTemplateFuncs are available in every template unless overridden.
+var builtinTemplateFuncs = TemplateFuncs{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	"title": func(s string) string {
+		r, size := utf8.DecodeRuneInString(s)
+		if size == 0 {
+			return s
+		}
+		return string(unicode.ToTitle(r)) + strings.ToLower(s[size:])
+	},
+}
+
+// Replacer applies a compiled replacement template to the matches of a
+// Regexp. The template language supports:
+//
+//	$name, ${name}      the text of a group, by name or number
+//	$$                  a literal $
+//	${name:-text}       the group, or text if the group did not participate
+//	${name:+yes:no}     yes if the group participated, otherwise no (":no" is optional)
+//	${func(name)}       a registered function applied to the group
+//	\U \L               upper or lower case everything up to \E
+//	\u \l               upper or lower case the next character
+//	\E                  end a \U or \L
+//	\\ \$ \: \}         literal characters
+//
+// As in Expand, $name takes the longest sequence of letters, digits and
+// underscores. The text inside defaults and conditionals is itself a template.
+// A Replacer is safe for concurrent use.
+type Replacer struct {
+	re    *Regexp
+	nodes []templateNode
+}
+
+// NewReplacer compiles template for use with the matches of r. Functions in
+// funcs are available alongside the built-in upper, lower, title and trim.
+func (r *Regexp) NewReplacer(template string, funcs TemplateFuncs) (*Replacer, error) {
+	nodes, err := parseTemplate(template, r.SubexpNames(), funcs)
+	if err != nil {
+		return nil, err
+	}
+	return &Replacer{re: r, nodes: nodes}, nil
+}
+
+// ReplaceAll returns a copy of s with every match replaced by the template.
+func (rp *Replacer) ReplaceAll(s string) string {
+	return rp.re.replaceAll(s, -1, func(dst []byte, loc []int) []byte {
+		return rp.expand(dst, s, loc)
+	})
+}
+
+// ReplaceFirst returns a copy of s with the leftmost match replaced by the
+// template.
+func (rp *Replacer) ReplaceFirst(s string) string {
+	return rp.re.replaceAll(s, 1, func(dst []byte, loc []int) []byte {
+		return rp.expand(dst, s, loc)
+	})
+}
+
+// expand appends the template, evaluated for the match with submatch indices
+// loc in s, to dst.
+func (rp *Replacer) expand(dst []byte, s string, loc []int) []byte {
+	w := caseWriter{buf: dst}
+	w.writeNodes(rp.nodes, s, loc)
+	return w.buf
+}
+
+type templateKind uint8
+
+const (
+	templateText templateKind = iota
+	templateGroup
+	templateCond
+	templateCase
+)
+
+// templateNode is one element of a compiled template.
+type templateNode struct {
+	kind  templateKind
+	text  string
+	group int
+	fn    func(string) string
+	// present is written by a conditional when the group participated; absent
+	// is written by a group reference or conditional when it did not.
+	present, absent []templateNode
+	caseOp          byte
+}
+
+// caseWriter appends text to buf, applying the active case modifiers.
+type caseWriter struct {
+	buf []byte
+	// mode is 'U' or 'L' while \U or \L is active, and next is 'u' or 'l'
+	// until the character after \u or \l has been written.
+	mode, next byte
+}
+
+func (w *caseWriter) writeString(s string) {
+	if w.mode == 0 && w.next == 0 {
+		w.buf = append(w.buf, s...)
+		return
+	}
+	for _, r := range s {
+		switch {
+		case w.next == 'u':
+			r, w.next = unicode.ToTitle(r), 0
+		case w.next == 'l':
+			r, w.next = unicode.ToLower(r), 0
+		case w.mode == 'U':
+			r = unicode.ToUpper(r)
+		case w.mode == 'L':
+			r = unicode.ToLower(r)
+		}
+		w.buf = utf8.AppendRune(w.buf, r)
+	}
+}
+
+func (w *caseWriter) writeNodes(nodes []templateNode, s string, loc []int) {
+	for i := range nodes {
+		n := &nodes[i]
+		switch n.kind {
+		case templateText:
+			w.writeString(n.text)
+		case templateGroup:
+			if 2*n.group < len(loc) && loc[2*n.group] >= 0 {
+				v := s[loc[2*n.group]:loc[2*n.group+1]]
+				if n.fn != nil {
+					v = n.fn(v)
+				}
+				w.writeString(v)
+			} else {
+				w.writeNodes(n.absent, s, loc)
+			}
+		case templateCond:
+			if 2*n.group < len(loc) && loc[2*n.group] >= 0 {
+				w.writeNodes(n.present, s, loc)
+			} else {
+				w.writeNodes(n.absent, s, loc)
+			}
+		case templateCase:
+			switch n.caseOp {
+			case 'U', 'L':
+				w.mode = n.caseOp
+			case 'u', 'l':
+				w.next = n.caseOp
+			case 'E':
+				w.mode, w.next = 0, 0
+			}
+		}
+	}
+}
+
+// templateParser compiles the template language described on Replacer.
+type templateParser struct {
+	src   string
+	pos   int
+	names []string
+	funcs TemplateFuncs
+}
+
+func parseTemplate(src string, names []string, funcs TemplateFuncs) ([]templateNode, error) {
+	p := &templateParser{src: src, names: names, funcs: funcs}
+	nodes, err := p.parse("")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	return nodes, nil
+}
+
+func (p *templateParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("template: %s at offset %d", fmt.Sprintf(format, args...), p.pos)
+}
+
+// parse compiles template text up to the end of the input or to the first
+// unescaped byte in stop, which is left unconsumed.
+func (p *templateParser) parse(stop string) ([]templateNode, error) {
+	var nodes []templateNode
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, templateNode{kind: templateText, text: text.String()})
+			text.Reset()
+		}
+	}
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case strings.IndexByte(stop, c) >= 0:
+			flush()
+			return nodes, nil
+		case c == '\\' && p.pos+1 < len(p.src):
+			e := p.src[p.pos+1]
+			p.pos += 2
+			switch e {
+			case 'U', 'L', 'E', 'u', 'l':
+				flush()
+				nodes = append(nodes, templateNode{kind: templateCase, caseOp: e})
+			case '\\', '$', ':', '}':
+				text.WriteByte(e)
+			default:
+				text.WriteByte('\\')
+				text.WriteByte(e)
+			}
+		case c == '$' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '$':
+			text.WriteByte('$')
+			p.pos += 2
+		case c == '$' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '{':
+			flush()
+			p.pos += 2
+			n, err := p.parseBrace()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, n)
+		case c == '$' && p.pos+1 < len(p.src) && isTemplateIdent(p.src[p.pos+1]):
+			flush()
+			p.pos++
+			group, err := p.group(p.ident())
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, templateNode{kind: templateGroup, group: group})
+		default:
+			text.WriteByte(c)
+			p.pos++
+		}
+	}
+	flush()
+	return nodes, nil
+}
+
+// parseBrace compiles the body of a ${...} expression, after the opening brace.
+func (p *templateParser) parseBrace() (templateNode, error) {
+	name := p.ident()
+	if name == "" {
+		return templateNode{}, p.errorf("expected a group or function name")
+	}
+	var n templateNode
+	switch {
+	case p.consume("}"):
+		group, err := p.group(name)
+		return templateNode{kind: templateGroup, group: group}, err
+	case p.consume("("):
+		fn, ok := p.funcs[name]
+		if !ok {
+			fn, ok = builtinTemplateFuncs[name]
+		}
+		if !ok {
+			return n, p.errorf("unknown function %q", name)
+		}
+		group, err := p.group(p.ident())
+		if err != nil {
+			return n, err
+		}
+		if !p.consume(")}") {
+			return n, p.errorf("expected \")}\"")
+		}
+		return templateNode{kind: templateGroup, group: group, fn: fn}, nil
+	case p.consume(":-"):
+		group, err := p.group(name)
+		if err != nil {
+			return n, err
+		}
+		n = templateNode{kind: templateGroup, group: group}
+		if n.absent, err = p.parse("}"); err != nil {
+			return n, err
+		}
+	case p.consume(":+"):
+		group, err := p.group(name)
+		if err != nil {
+			return n, err
+		}
+		n = templateNode{kind: templateCond, group: group}
+		if n.present, err = p.parse(":}"); err != nil {
+			return n, err
+		}
+		if p.consume(":") {
+			if n.absent, err = p.parse("}"); err != nil {
+				return n, err
+			}
+		}
+	default:
+		return n, p.errorf("malformed ${%s", name)
+	}
+	if !p.consume("}") {
+		return n, p.errorf("unterminated ${%s", name)
+	}
+	return n, nil
+}
+
+// ident consumes and returns a run of letters, digits and underscores.
+func (p *templateParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.src) && isTemplateIdent(p.src[p.pos]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// consume advances past s if the input continues with it.
+func (p *templateParser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// group resolves a group reference by number or name.
+func (p *templateParser) group(name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 0 || n >= len(p.names) {
+			return 0, p.errorf("no group %d", n)
+		}
+		return n, nil
+	}
+	for i, s := range p.names {
+		if s == name && name != "" {
+			return i, nil
+		}
+	}
+	return 0, p.errorf("unknown group %q", name)
+}
+
+func isTemplateIdent(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,224 @@
+package tinyrebuilder
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// defaultScanChunkSize is the chunk size used when ScanOptions.ChunkSize is
+// not set.
+const defaultScanChunkSize = 1 << 20
+
+// ScanOptions configures a parallel scan.
+type ScanOptions struct {
+	// Workers is the number of goroutines scanning chunks. If it is not
+	// positive, GOMAXPROCS is used.
+	Workers int
+	// ChunkSize is the approximate number of bytes in each chunk. Chunk
+	// boundaries are moved to the next line start, so no line is split
+	// between chunks. If it is not positive, 1 MiB is used.
+	ChunkSize int
+	// AllMatches reports every match on a matching line instead of only the
+	// leftmost one.
+	AllMatches bool
+}
+
+// LineMatch is a line on which a scan found a match.
+type LineMatch struct {
+	// Line is the 1-based number of the line.
+	Line int
+	// Offset is the byte offset of the start of the line in the input.
+	Offset int64
+	// Text is the line without its trailing newline.
+	Text string
+	// Matches holds the bounds of the matches within Text.
+	Matches [][]int
+}
+
+// ScanFile scans the file at path line by line for matches of re, as Scan
+// does, and returns the matching lines in file order.
+func ScanFile(path string, re *Regexp, opts ScanOptions) ([]LineMatch, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var out []LineMatch
+	err = Scan(f, info.Size(), re, opts, func(m LineMatch) error {
+		out = append(out, m)
+		return nil
+	})
+	return out, err
+}
+
+// Scan reads the first size bytes of r in line-aligned chunks, matches each
+// line against re on several goroutines, and calls fn for every matching line
+// in input order. Each line is matched on its own, so ^ and $ refer to the
+// start and end of the line. At most twice as many chunks as there are
+// workers are held in memory at once. If fn returns an error, the scan stops
+// and Scan returns that error.
+func Scan(r io.ReaderAt, size int64, re *Regexp, opts ScanOptions, fn func(LineMatch) error) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	chunkSize := int64(opts.ChunkSize)
+	if chunkSize <= 0 {
+		chunkSize = defaultScanChunkSize
+	}
+	type job struct {
+		start, end int64
+		out        chan<- scanChunk
+	}
+	jobs := make(chan job)
+	pending := make(chan chan scanChunk, 2*workers)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf []byte
+			for j := range jobs {
+				var c scanChunk
+				c, buf = scanChunkAt(r, j.start, j.end, re, opts.AllMatches, buf)
+				j.out <- c
+			}
+		}()
+	}
+	// The chunk boundaries are found in order, each chunk ending at the first
+	// line start at least chunkSize bytes after its own start, so the input
+	// is searched for them only once, however long its lines are.
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+		for start := int64(0); start < size; {
+			end, err := lineStartAt(r, size, start+chunkSize)
+			out := make(chan scanChunk, 1)
+			select {
+			case pending <- out:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				out <- scanChunk{err: err}
+				return
+			}
+			select {
+			case jobs <- job{start, end, out}:
+			case <-stop:
+				close(out)
+				return
+			}
+			start = end
+		}
+	}()
+
+	var err error
+	line := 1
+	for out := range pending {
+		c := <-out
+		if err == nil {
+			err = c.err
+		}
+		for i := 0; err == nil && i < len(c.matches); i++ {
+			m := c.matches[i]
+			m.Line += line
+			err = fn(m)
+		}
+		line += c.lines
+		if err != nil {
+			break
+		}
+	}
+	close(stop)
+	// Drain the chunks already handed out so the workers can finish.
+	for out := range pending {
+		<-out
+	}
+	wg.Wait()
+	return err
+}
+
+// scanChunk holds the result of scanning one chunk. Line numbers in matches
+// are relative to the first line of the chunk, counting from 0.
+type scanChunk struct {
+	matches []LineMatch
+	lines   int
+	err     error
+}
+
+// scanChunkAt scans the lines of r in [from, to), which begins and ends at
+// line starts. It reads them into buf, growing it if need be, and returns buf
+// for the next chunk.
+func scanChunkAt(r io.ReaderAt, from, to int64, re *Regexp, all bool, buf []byte) (scanChunk, []byte) {
+	if n := int(to - from); cap(buf) < n {
+		buf = make([]byte, n)
+	} else {
+		buf = buf[:n]
+	}
+	if _, err := r.ReadAt(buf, from); err != nil && err != io.EOF {
+		return scanChunk{err: err}, buf
+	}
+	// The text shares buf, which the next chunk overwrites, so the lines kept
+	// in the matches are copied.
+	text := byteString(buf)
+
+	var c scanChunk
+	for pos := 0; pos < len(text); c.lines++ {
+		lineEnd := strings.IndexByte(text[pos:], '\n')
+		next := pos + lineEnd + 1
+		if lineEnd < 0 {
+			lineEnd, next = len(text)-pos, len(text)
+		}
+		line := text[pos : pos+lineEnd]
+		var locs [][]int
+		if all {
+			locs = re.FindAllStringIndex(line, -1)
+		} else if loc := re.FindStringIndex(line); loc != nil {
+			locs = [][]int{loc}
+		}
+		if locs != nil {
+			c.matches = append(c.matches, LineMatch{
+				Line:    c.lines,
+				Offset:  from + int64(pos),
+				Text:    strings.Clone(line),
+				Matches: locs,
+			})
+		}
+		pos = next
+	}
+	return c, buf
+}
+
+// lineStartAt returns the offset of the first line of r that begins at or
+// after pos, or size if there is none.
+func lineStartAt(r io.ReaderAt, size, pos int64) (int64, error) {
+	if pos <= 0 {
+		return 0, nil
+	}
+	var buf [4096]byte
+	// A line begins at pos if the byte before it is a newline.
+	for off := pos - 1; off < size; {
+		n, err := r.ReadAt(buf[:min(int64(len(buf)), size-off)], off)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return off + int64(i) + 1, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		off += int64(n)
+	}
+	return size, nil
+}
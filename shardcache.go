@@ -0,0 +1,143 @@
+package tinyrebuilder
+
+import (
+	"fmt"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// NewShardedCache returns a CacheFactory for caches that spread patterns over
+// independent shards by a hash of the pattern, so that goroutines compiling
+// different patterns rarely contend. If shards is not positive, GOMAXPROCS
+// is used. The capacity is divided evenly among the shards.
+//
+// Lookups that hit take no lock: each shard keeps its entries in a sync.Map
+// and marks them as used, and a shard that is full evicts with the CLOCK
+// algorithm, giving a marked entry a second chance. This approximates least
+// recently used eviction within each shard.
+func NewShardedCache(shards int) CacheFactory {
+	return func(size int, onEvict func(CacheKey, *Regexp)) (Cache, error) {
+		if size <= 0 {
+			return nil, fmt.Errorf("cache size must be positive")
+		}
+		n := shards
+		if n <= 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		n = max(min(n, size), 1)
+		c := &shardedCache{seed: maphash.MakeSeed(), shards: make([]clockShard, n), onEvict: onEvict}
+		for i := range c.shards {
+			// Spread the remainder over the first shards.
+			c.shards[i].size = size / n
+			if i < size%n {
+				c.shards[i].size++
+			}
+		}
+		return c, nil
+	}
+}
+
+type shardedCache struct {
+	seed    maphash.Seed
+	shards  []clockShard
+	onEvict func(CacheKey, *Regexp)
+}
+
+func (c *shardedCache) shard(key CacheKey) *clockShard {
+	return &c.shards[maphash.String(c.seed, key.Pattern)%uint64(len(c.shards))]
+}
+
+func (c *shardedCache) Get(key CacheKey) (*Regexp, bool) {
+	return c.shard(key).get(key)
+}
+
+func (c *shardedCache) Add(key CacheKey, re *Regexp) {
+	if old, ok := c.shard(key).add(key, re); ok && c.onEvict != nil {
+		c.onEvict(old.key, old.re)
+	}
+}
+
+func (c *shardedCache) Len() int {
+	n := 0
+	for i := range c.shards {
+		n += int(c.shards[i].len.Load())
+	}
+	return n
+}
+
+// Keys lists the patterns used since the clock hand last passed them before
+// the others, which is as much as the shards know of their order of use.
+func (c *shardedCache) Keys() []CacheKey {
+	var used, unused []CacheKey
+	for i := range c.shards {
+		c.shards[i].entries.Range(func(_, v any) bool {
+			if e := v.(*clockEntry); e.used.Load() {
+				used = append(used, e.key)
+			} else {
+				unused = append(unused, e.key)
+			}
+			return true
+		})
+	}
+	return append(used, unused...)
+}
+
+// clockEntry is an entry of a clockShard.
+type clockEntry struct {
+	key  CacheKey
+	re   *Regexp
+	used atomic.Bool
+}
+
+// clockShard is one shard of a shardedCache. Its entries sit on a ring swept
+// by a clock hand when room is needed.
+type clockShard struct {
+	entries sync.Map
+	len     atomic.Int64
+
+	mu   sync.Mutex
+	ring []*clockEntry
+	hand int
+	size int
+}
+
+func (s *clockShard) get(key CacheKey) (*Regexp, bool) {
+	v, ok := s.entries.Load(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(*clockEntry)
+	// Avoid writing to a shared cache line when the mark is already set.
+	if !e.used.Load() {
+		e.used.Store(true)
+	}
+	return e.re, true
+}
+
+// add stores re under key, returning the entry it evicted, if any.
+func (s *clockShard) add(key CacheKey, re *Regexp) (*clockEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries.Load(key); ok {
+		return nil, false
+	}
+	e := &clockEntry{key: key, re: re}
+	if len(s.ring) < s.size {
+		s.ring = append(s.ring, e)
+		s.entries.Store(key, e)
+		s.len.Add(1)
+		return nil, false
+	}
+	for s.ring[s.hand].used.Load() {
+		s.ring[s.hand].used.Store(false)
+		s.hand = (s.hand + 1) % len(s.ring)
+	}
+	old := s.ring[s.hand]
+	s.entries.Delete(old.key)
+	s.ring[s.hand] = e
+	s.entries.Store(key, e)
+	s.hand = (s.hand + 1) % len(s.ring)
+	return old, true
+}
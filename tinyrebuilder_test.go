@@ -1,7 +1,23 @@
 package tinyrebuilder_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/nulln0ne/tinyrebuilder"
 	"github.com/nulln0ne/tinyrebuilder/patterns"
@@ -516,6 +532,71 @@ func BenchmarkEmailPatternCompilationWithCache(b *testing.B) {
 	}
 }
 
+func BenchmarkEmailPatternCompilationWithCacheParallel(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		backend tinyrebuilder.CacheFactory
+	}{
+		{"LRU", tinyrebuilder.NewLRUCache},
+		{"Sharded", tinyrebuilder.NewShardedCache(0)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			if err := tinyrebuilder.SetCacheBackend(bc.backend); err != nil {
+				b.Fatal(err)
+			}
+			defer tinyrebuilder.SetCacheBackend(tinyrebuilder.NewLRUCache)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_ = patterns.Email().MustCompileWithCache()
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCompilerParallelManyPatterns compiles a working set of distinct
+// patterns, all cached, from parallel goroutines, so that lookups spread
+// over the shards of the sharded backend.
+func BenchmarkCompilerParallelManyPatterns(b *testing.B) {
+	patterns := make([]string, 1024)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf(`user_%d=(\d+)`, i)
+	}
+	for _, bc := range []struct {
+		name      string
+		backend   tinyrebuilder.CacheFactory
+		canonical bool
+	}{
+		{"LRU", tinyrebuilder.NewLRUCache, false},
+		{"Sharded", tinyrebuilder.NewShardedCache(0), false},
+		{"Canonical", tinyrebuilder.NewLRUCache, true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			// Leave room for the shards to fill unevenly.
+			c, err := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+				CacheSize:     2 * len(patterns),
+				Backend:       bc.backend,
+				CanonicalKeys: bc.canonical,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, p := range patterns {
+				c.MustCompile(tinyrebuilder.New().Raw(p))
+			}
+			var seed atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := int(seed.Add(7919)); pb.Next(); i++ {
+					c.MustCompile(tinyrebuilder.New().Raw(patterns[i%len(patterns)]))
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkURLPatternCompilation(b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
@@ -534,3 +615,2388 @@ func BenchmarkURLPatternCompilation(b *testing.B) {
 			MustCompile()
 	}
 }
+
+// logCorpus returns deterministic log-like text in which roughly one line in
+// every hundred contains an email address.
+func logCorpus(lines int) string {
+	var sb strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&sb, "2025-07-21T10:%02d:%02d INFO request id=%d path=/api/v1/items/%d status=200 took=%dms",
+			i%60, (i*7)%60, i, i*31, i%97)
+		if i%100 == 0 {
+			fmt.Fprintf(&sb, " user=user%d.name@example.com", i)
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// findEmail matches email addresses anywhere in the input.
+func findEmail() *tinyrebuilder.RegexBuilder {
+	return tinyrebuilder.New().
+		Raw(`[a-zA-Z0-9._%+\-]+`).
+		Literal("@").
+		Raw(`[a-zA-Z0-9.\-]+\.[a-zA-Z]{1,}`)
+}
+
+func TestPrefilterMatchesStdlib(t *testing.T) {
+	patterns := []*tinyrebuilder.RegexBuilder{
+		findEmail(),
+		patterns.Email(),
+		tinyrebuilder.New().Literal("needle"),
+		tinyrebuilder.New().WithFlags("i").Literal("needle"),
+		tinyrebuilder.New().Raw(`(cat|dog)s?\d+`),
+		tinyrebuilder.New().Raw(`(?m)^id=\d+$`),
+		tinyrebuilder.New().Raw(`\bfoo\w*bar\b`),
+		tinyrebuilder.New().Raw(`x\s+y`),
+		tinyrebuilder.New().Raw(`\Aab|cd\z`),
+		tinyrebuilder.New().Raw(`a*`),
+		tinyrebuilder.New().Raw(`(?P<k>\w+)=(?P<v>\d+)`),
+	}
+	inputs := []string{
+		"",
+		"needle",
+		"a NEEDLE in a haystack",
+		"mail bob@example.com and alice@example.org\nnothing here\ncarol@test.io",
+		"cats12 dog3 cat dogs\ncat7",
+		"id=1\nid=x\nid=22",
+		"foobar foo_bar xfoobar foobarbaz",
+		"x \n y x  y",
+		"abcd\ncd",
+		"\xffneedle\xfe@\xfd.com",
+		"a=1;bb=22;c=x",
+		logCorpus(300),
+	}
+	for _, b := range patterns {
+		re := b.MustCompile()
+		std := re.Unwrap()
+		for _, s := range inputs {
+			if got, want := re.MatchString(s), std.MatchString(s); got != want {
+				t.Errorf("%s: MatchString(%.20q) = %v; want %v", re, s, got, want)
+			}
+			if got, want := re.FindStringIndex(s), std.FindStringIndex(s); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: FindStringIndex(%.20q) = %v; want %v", re, s, got, want)
+			}
+			if got, want := re.FindStringSubmatch(s), std.FindStringSubmatch(s); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: FindStringSubmatch(%.20q) = %q; want %q", re, s, got, want)
+			}
+			for _, n := range []int{-1, 0, 1, 2} {
+				if got, want := re.FindAllStringIndex(s, n), std.FindAllStringIndex(s, n); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: FindAllStringIndex(%.20q, %d) = %v; want %v", re, s, n, got, want)
+				}
+				if got, want := re.FindAllStringSubmatch(s, n), std.FindAllStringSubmatch(s, n); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: FindAllStringSubmatch(%.20q, %d) = %q; want %q", re, s, n, got, want)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkPrefilterIsMatchLines(b *testing.B) {
+	lines := strings.Split(logCorpus(1000), "\n")
+	re := patterns.Email().MustCompile()
+	b.Run("stdlib", func(b *testing.B) {
+		std := re.Unwrap()
+		for i := 0; i < b.N; i++ {
+			for _, line := range lines {
+				_ = std.MatchString(line)
+			}
+		}
+	})
+	b.Run("prefilter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, line := range lines {
+				_ = re.IsMatch(line)
+			}
+		}
+	})
+}
+
+func BenchmarkPrefilterFindAll(b *testing.B) {
+	text := logCorpus(10000)
+	re := findEmail().MustCompile()
+	b.Run("stdlib", func(b *testing.B) {
+		std := re.Unwrap()
+		b.SetBytes(int64(len(text)))
+		for i := 0; i < b.N; i++ {
+			_ = std.FindAllString(text, -1)
+		}
+	})
+	b.Run("prefilter", func(b *testing.B) {
+		b.SetBytes(int64(len(text)))
+		for i := 0; i < b.N; i++ {
+			_ = re.FindAllString(text, -1)
+		}
+	})
+}
+
+func TestLiteralFastPathMatchesStdlib(t *testing.T) {
+	builders := []*tinyrebuilder.RegexBuilder{
+		tinyrebuilder.New().Literal("some_pattern"),
+		tinyrebuilder.New().Literal("ab"),
+		tinyrebuilder.New().StartAnchor().Literal("ab"),
+		tinyrebuilder.New().Literal("ab").EndAnchor(),
+		tinyrebuilder.New().StartAnchor().Literal("ab").EndAnchor(),
+		tinyrebuilder.New().WithFlags("i").StartAnchor().Literal("straße and ÅNGSTRÖM").EndAnchor(),
+		tinyrebuilder.New().WithFlags("i").Literal("ab"),
+		tinyrebuilder.New().Literal("cat").Or(tinyrebuilder.New().Literal("dog"), tinyrebuilder.New().Literal("bird")),
+		tinyrebuilder.New().StartAnchor().NonCapturingGroup(tinyrebuilder.New().Literal("a").Or(tinyrebuilder.New().Literal("ab"))),
+		tinyrebuilder.New().NonCapturingGroup(tinyrebuilder.New().Literal("b").Or(tinyrebuilder.New().Literal("ab"))).EndAnchor(),
+		tinyrebuilder.New().Literal("a").Or(tinyrebuilder.New().Literal("ab")),
+		tinyrebuilder.New().Literal("colo").Literal("u").Maybe().Literal("r"),
+		tinyrebuilder.New().AnyOf("xy").Literal("z"),
+		tinyrebuilder.New().Literal("é"),
+	}
+	rng := rand.New(rand.NewSource(1))
+	alphabet := []string{"a", "b", "A", "B", "x", "y", "z", "é", "É", "\xff", "cat", "dog", "ab", "color", "colour", "some_pattern"}
+	inputs := []string{"", "ab", "straße and ÅNGSTRÖM", "STRASSE AND ångström", "STRAßE AND ÅNGSTRÖM"}
+	for i := 0; i < 500; i++ {
+		var sb strings.Builder
+		for j := rng.Intn(8); j > 0; j-- {
+			sb.WriteString(alphabet[rng.Intn(len(alphabet))])
+		}
+		inputs = append(inputs, sb.String())
+	}
+	for _, b := range builders {
+		re := b.MustCompile()
+		std := re.Unwrap()
+		for _, s := range inputs {
+			if got, want := re.MatchString(s), std.MatchString(s); got != want {
+				t.Fatalf("%s: MatchString(%q) = %v; want %v", re, s, got, want)
+			}
+			if got, want := re.FindStringIndex(s), std.FindStringIndex(s); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: FindStringIndex(%q) = %v; want %v", re, s, got, want)
+			}
+			if got, want := re.FindStringSubmatch(s), std.FindStringSubmatch(s); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: FindStringSubmatch(%q) = %q; want %q", re, s, got, want)
+			}
+			if got, want := re.FindAllString(s, -1), std.FindAllString(s, -1); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: FindAllString(%q) = %q; want %q", re, s, got, want)
+			}
+			if got, want := re.FindAllStringIndex(s, 2), std.FindAllStringIndex(s, 2); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: FindAllStringIndex(%q, 2) = %v; want %v", re, s, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkLiteralFastPath(b *testing.B) {
+	text := logCorpus(100)
+	re := tinyrebuilder.New().Literal("status=500").MustCompile()
+	b.Run("stdlib", func(b *testing.B) {
+		std := re.Unwrap()
+		for i := 0; i < b.N; i++ {
+			_ = std.MatchString(text)
+		}
+	})
+	b.Run("fastpath", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = re.IsMatch(text)
+		}
+	})
+}
+
+// machinePatterns exercises the submatch machine against the standard library.
+var machinePatterns = []string{
+	`(a+)(b+)?`,
+	`(?P<k>\w+)=(?P<v>\d*)`,
+	`(a|ab)(c|bcd)(d*)`,
+	`x*`,
+	`(a*)+`,
+	`(a*)*?b`,
+	`^(\w+)\s`,
+	`(?m)^(\d+)$`,
+	`\b(\w)(\w*)\b`,
+	`(?i)(é+)(Ä)`,
+	`(?s)a.(.)`,
+	`a.b`,
+	`(?U)(a+)(a*)`,
+	`(a{2,3}){2}`,
+	`[^\x00-\x{10FFFF}]`,
+	`(\pL+)\z`,
+	`$`,
+}
+
+// randomInputs returns deterministic pseudo-random strings over alphabet.
+func randomInputs(seed int64, n int, alphabet []string) []string {
+	rng := rand.New(rand.NewSource(seed))
+	out := []string{""}
+	for i := 0; i < n; i++ {
+		var sb strings.Builder
+		for j := rng.Intn(10); j > 0; j-- {
+			sb.WriteString(alphabet[rng.Intn(len(alphabet))])
+		}
+		out = append(out, sb.String())
+	}
+	return out
+}
+
+func TestFindSubmatchIndexIntoMatchesStdlib(t *testing.T) {
+	inputs := randomInputs(2, 400, []string{"a", "b", "c", "d", "x", "=", "1", " ", "\n", "é", "É", "ä", "Ä", "\xff", "ab", "k=12"})
+	// Short inputs are searched by backtracking, long ones by the machine.
+	inputs = append(inputs, strings.Repeat("ab x\n", 20000)+"k=12 aab", strings.Repeat("é", 30000)+"bcd")
+	for _, p := range machinePatterns {
+		re := tinyrebuilder.New().Raw(p).MustCompile()
+		std := re.Unwrap()
+		m := re.NewMatcher()
+		var dst []int
+		for _, s := range inputs {
+			want := std.FindStringSubmatchIndex(s)
+			dst = re.FindSubmatchIndexInto(dst, s)
+			if !reflect.DeepEqual(dst, want) {
+				t.Fatalf("%s: FindSubmatchIndexInto(%q) = %v; want %v", p, s, dst, want)
+			}
+			if got := m.FindSubmatchIndex(s); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: Matcher.FindSubmatchIndex(%q) = %v; want %v", p, s, got, want)
+			}
+			if got := m.MatchString(s); got != (want != nil) {
+				t.Fatalf("%s: Matcher.MatchString(%q) = %v; want %v", p, s, got, want != nil)
+			}
+		}
+	}
+}
+
+// keyValueInput is searched by the key=value fixture of keyValueBuilder.
+const keyValueInput = "some text with user_id=12345 in it"
+
+// keyValueBuilder returns a builder for the key=value pattern with named
+// groups shared by the submatch tests and benchmarks.
+func keyValueBuilder() *tinyrebuilder.RegexBuilder {
+	return tinyrebuilder.New().
+		NamedGroup("key", tinyrebuilder.WordChar().OneOrMore()).
+		Literal("=").
+		NamedGroup("value", tinyrebuilder.Digit().OneOrMore())
+}
+
+func BenchmarkFindStringSubmatch(b *testing.B) {
+	re := keyValueBuilder().MustCompile()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = re.FindStringSubmatch(keyValueInput)
+	}
+}
+
+func BenchmarkStdlibFindStringSubmatchIndex(b *testing.B) {
+	re := regexp.MustCompile(keyValueBuilder().Build())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = re.FindStringSubmatchIndex(keyValueInput)
+	}
+}
+
+func BenchmarkFindSubmatchIndexInto(b *testing.B) {
+	re := keyValueBuilder().MustCompile()
+	dst := make([]int, 0, 2*(re.NumSubexp()+1))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = re.FindSubmatchIndexInto(dst, keyValueInput)
+	}
+}
+
+func BenchmarkMatcherFindSubmatchIndex(b *testing.B) {
+	re := keyValueBuilder().MustCompile()
+	m := re.NewMatcher()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = m.FindSubmatchIndex(keyValueInput)
+	}
+}
+
+func TestFindAllOverlapping(t *testing.T) {
+	testCases := []struct {
+		name    string
+		builder *tinyrebuilder.RegexBuilder
+		input   string
+		want    [][]int
+	}{
+		{"Motif", tinyrebuilder.New().Literal("aa"), "aaaa", [][]int{{0, 2}, {1, 3}, {2, 4}}},
+		{"Greedy", tinyrebuilder.New().Literal("a").OneOrMore(), "aab", [][]int{{0, 2}, {1, 2}}},
+		{"Empty", tinyrebuilder.New().Literal("x").ZeroOrMore(), "aé", [][]int{{0, 0}, {1, 1}, {3, 3}}},
+		{"Multibyte", tinyrebuilder.New().Literal("é").Raw("."), "ééé", [][]int{{0, 4}, {2, 6}}},
+		{"InvalidUTF8", tinyrebuilder.New().Raw("."), "a\xffé", [][]int{{0, 1}, {1, 2}, {2, 4}}},
+		{"WordBoundary", tinyrebuilder.New().WordBoundary().WordChar().OneOrMore(), "go gopher", [][]int{{0, 2}, {3, 9}}},
+		{"NoMatch", tinyrebuilder.New().Literal("zz"), "aaaa", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			re := tc.builder.MustCompile()
+			got := re.FindAllOverlapping(tc.input, -1)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("FindAllOverlapping(%q) = %v; want %v", tc.input, got, tc.want)
+			}
+			var last []int
+			if len(tc.want) > 0 {
+				last = tc.want[len(tc.want)-1]
+			}
+			if got := re.FindLast(tc.input); !reflect.DeepEqual(got, last) {
+				t.Errorf("FindLast(%q) = %v; want %v", tc.input, got, last)
+			}
+			if got := re.FindAllOverlapping(tc.input, 1); len(tc.want) > 0 && !reflect.DeepEqual(got, tc.want[:1]) {
+				t.Errorf("FindAllOverlapping(%q, 1) = %v; want %v", tc.input, got, tc.want[:1])
+			}
+		})
+	}
+}
+
+// TestFindLastLongInput runs FindLast over a long run that every position
+// begins a partial match in, which takes time quadratic in the length of the
+// run if each position is tried on its own.
+func TestFindLastLongInput(t *testing.T) {
+	re := tinyrebuilder.New().Literal("a").OneOrMore().Raw("(?:b|$)").MustCompile()
+	run := strings.Repeat("a", 100000)
+	if got := re.FindLast(run + " "); got != nil {
+		t.Errorf("FindLast() = %v; want nil", got)
+	}
+	if got, want := re.FindLast(run+"b "), []int{len(run) - 1, len(run) + 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindLast() = %v; want %v", got, want)
+	}
+	if got, want := re.FindLast("ab "+run), []int{len(run) + 2, len(run) + 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindLast() = %v; want %v", got, want)
+	}
+}
+func TestFindAllOverlappingMatchesAnchoredStdlib(t *testing.T) {
+	inputs := randomInputs(3, 200, []string{"a", "b", "ab", "é", "\xff", " "})
+	for _, p := range []string{`a+b?`, `(a|ab)(b*)`, `é*`, `[^a]`, `b|ab`, `a+(?:b|$)`} {
+		re := tinyrebuilder.New().Raw(p).MustCompile()
+		anchored := regexp.MustCompile(`\A(?:` + p + `)`)
+		for _, s := range inputs {
+			var want [][]int
+			for pos := 0; pos <= len(s); {
+				if loc := anchored.FindStringIndex(s[pos:]); loc != nil {
+					want = append(want, []int{pos + loc[0], pos + loc[1]})
+				}
+				if pos == len(s) {
+					break
+				}
+				_, width := utf8.DecodeRuneInString(s[pos:])
+				pos += width
+			}
+			if got := re.FindAllOverlapping(s, -1); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: FindAllOverlapping(%q) = %v; want %v", p, s, got, want)
+			}
+			var last []int
+			if len(want) > 0 {
+				last = want[len(want)-1]
+			}
+			if got := re.FindLast(s); !reflect.DeepEqual(got, last) {
+				t.Fatalf("%s: FindLast(%q) = %v; want %v", p, s, got, last)
+			}
+		}
+	}
+}
+
+func TestMatchAt(t *testing.T) {
+	re := tinyrebuilder.New().WordBoundary().Literal("bar").MustCompile()
+	testCases := []struct {
+		input string
+		pos   int
+		want  bool
+	}{
+		{"foo bar", 4, true},
+		{"foobar", 3, false}, // no word boundary before "bar"
+		{"foo bar", 3, false},
+		{"foo bar", -1, false},
+		{"foo bar", 8, false},
+		{"é bar", 3, true},
+	}
+	for _, tc := range testCases {
+		if got := re.MatchAt(tc.input, tc.pos); got != tc.want {
+			t.Errorf("MatchAt(%q, %d) = %v; want %v", tc.input, tc.pos, got, tc.want)
+		}
+	}
+
+	start := tinyrebuilder.New().StartAnchor().Literal("a").MustCompile()
+	if !start.MatchAt("aa", 0) || start.MatchAt("aa", 1) {
+		t.Error("Expected the start anchor to hold only at offset 0")
+	}
+	multibyte := tinyrebuilder.New().Raw(".").MustCompile()
+	if multibyte.MatchAt("é", 1) {
+		t.Error("Expected NOT to match inside a multibyte rune")
+	}
+	if !multibyte.MatchAt("é", 0) || multibyte.MatchAt("é", 2) {
+		t.Error("Expected to match only at the start of the rune")
+	}
+	empty := tinyrebuilder.New().Literal("x").ZeroOrMore().MustCompile()
+	if !empty.MatchAt("ab", 2) {
+		t.Error("Expected an empty match at the end of the input")
+	}
+}
+
+func TestFindMatchTreeRepeated(t *testing.T) {
+	pair := tinyrebuilder.New().
+		NamedGroup("key", tinyrebuilder.WordChar().OneOrMore()).
+		Literal("=").
+		NamedGroup("value", tinyrebuilder.Digit().OneOrMore())
+	re := tinyrebuilder.New().
+		NonCapturingGroup(tinyrebuilder.New().NamedGroup("pair", pair).Literal(";").Maybe()).
+		OneOrMore().
+		MustCompile()
+
+	tree := re.FindMatchTree("a=1;b=2;c=3")
+	if tree == nil {
+		t.Fatal("Expected to find a match in 'a=1;b=2;c=3'")
+	}
+	pairs := tree.Repeated("pair")
+	want := []string{"a=1", "b=2", "c=3"}
+	if len(pairs) != len(want) {
+		t.Fatalf("Expected %d pairs, got %d", len(want), len(pairs))
+	}
+	for i, p := range pairs {
+		if p.Text != want[i] {
+			t.Errorf("pair %d = %q; want %q", i, p.Text, want[i])
+		}
+		keys := p.Repeated("key")
+		if len(keys) != 1 || keys[0].Text != want[i][:1] {
+			t.Errorf("pair %d keys = %v; want [%s]", i, keys, want[i][:1])
+		}
+	}
+	if got := re.FindStringSubmatch("a=1;b=2;c=3")[1]; got != "c=3" {
+		t.Errorf("Expected FindStringSubmatch to keep only the last pair, got %q", got)
+	}
+	if re.FindMatchTree("no pairs here!") != nil {
+		t.Error("Expected no match in 'no pairs here!'")
+	}
+}
+
+// TestFindMatchTreeManyIterations expands a region of thousands of
+// iterations, which takes time quadratic in their number if each iteration is
+// matched together with the rest of the region.
+func TestFindMatchTreeManyIterations(t *testing.T) {
+	re := tinyrebuilder.New().Raw(`(?:(?P<key>\w+)=(?P<value>\d+);)+`).MustCompile()
+	const n = 20000
+	input := strings.Repeat("a=1;", n-1) + "z=9;"
+	tree := re.FindMatchTree(input)
+	if tree == nil {
+		t.Fatal("Expected a match")
+	}
+	keys := tree.Repeated("key")
+	if len(keys) != n {
+		t.Fatalf("Got %d iterations; want %d", len(keys), n)
+	}
+	if last := keys[n-1]; last.Text != "z" || last.Start != len(input)-4 {
+		t.Errorf("Last key = %+v; want z at %d", last, len(input)-4)
+	}
+}
+
+func TestFindMatchTreeNestedAndBounded(t *testing.T) {
+	re := tinyrebuilder.New().Raw(`(?:(?P<w>\w)(?:,(?P<n>\d))*;)+`).MustCompile()
+	tree := re.FindMatchTree("a,1,2;b;c,3;")
+	var words, nums []string
+	for _, m := range tree.Repeated("w") {
+		words = append(words, m.Text)
+	}
+	for _, m := range tree.Repeated("n") {
+		nums = append(nums, m.Text)
+	}
+	if !reflect.DeepEqual(words, []string{"a", "b", "c"}) || !reflect.DeepEqual(nums, []string{"1", "2", "3"}) {
+		t.Errorf("Got words %q and numbers %q", words, nums)
+	}
+
+	// The iterations must tile the region the way the original match did.
+	bounded := tinyrebuilder.New().Raw(`(?P<x>a|aa){1,2}b`).MustCompile()
+	var xs []string
+	for _, m := range bounded.FindMatchTree("aaab").Repeated("x") {
+		xs = append(xs, m.Text)
+	}
+	if !reflect.DeepEqual(xs, []string{"a", "aa"}) {
+		t.Errorf("Got iterations %q; want [a aa]", xs)
+	}
+}
+
+func TestFindMatchTreeLastIterationMatchesStdlib(t *testing.T) {
+	patterns := []string{
+		`(?:(?P<a>a|ab)(?P<b>c|bcd))+(?P<c>d*)`,
+		`(?:(?P<a>\w+)=(?P<b>\d+);?)+`,
+		`(?:(?P<a>a)|(?P<b>b))*c`,
+		`(?P<a>x(?P<b>y)*)+`,
+		`(?:(?P<a>a*))+b`,
+		`(?P<a>[ab]){2,3}`,
+	}
+	inputs := randomInputs(4, 300, []string{"a", "b", "c", "d", "x", "y", "=", "1", ";", "ab", "bcd"})
+	for _, p := range patterns {
+		re := tinyrebuilder.New().Raw(p).MustCompile()
+		std := re.Unwrap()
+		for _, s := range inputs {
+			loc := std.FindStringSubmatchIndex(s)
+			tree := re.FindMatchTree(s)
+			if (loc == nil) != (tree == nil) {
+				t.Fatalf("%s: FindMatchTree(%q) = %v; want match %v", p, s, tree, loc)
+			}
+			if tree == nil {
+				continue
+			}
+			if tree.Start != loc[0] || tree.End != loc[1] {
+				t.Fatalf("%s: FindMatchTree(%q) spans [%d %d]; want %v", p, s, tree.Start, tree.End, loc[:2])
+			}
+			for i, name := range std.SubexpNames() {
+				if name == "" {
+					continue
+				}
+				reps := tree.Repeated(name)
+				if loc[2*i] < 0 {
+					if len(reps) != 0 {
+						t.Fatalf("%s: %q: group %s did not participate but got %v", p, s, name, reps)
+					}
+					continue
+				}
+				if len(reps) == 0 {
+					t.Fatalf("%s: %q: group %s has no iterations", p, s, name)
+				}
+				last := reps[len(reps)-1]
+				if last.Start != loc[2*i] || last.End != loc[2*i+1] {
+					t.Fatalf("%s: %q: last iteration of %s spans [%d %d]; want [%d %d]",
+						p, s, name, last.Start, last.End, loc[2*i], loc[2*i+1])
+				}
+			}
+		}
+	}
+}
+
+func TestMatchTreeHierarchy(t *testing.T) {
+	host := tinyrebuilder.New().Raw(`[a-z0-9.\-]+`)
+	port := tinyrebuilder.Digit().OneOrMore()
+	authority := tinyrebuilder.New().
+		NonCapturingGroup(tinyrebuilder.New().NamedGroup("user", tinyrebuilder.WordChar().OneOrMore()).Literal("@")).Maybe().
+		NamedGroup("host", host).
+		NonCapturingGroup(tinyrebuilder.New().Literal(":").NamedGroup("port", port)).Maybe()
+	re := tinyrebuilder.New().
+		NamedGroup("scheme", tinyrebuilder.New().Raw(`[a-z]+`)).
+		Literal("://").
+		NamedGroup("authority", authority).
+		NamedGroup("path", tinyrebuilder.New().Raw(`/[^?#\s]*`)).Maybe().
+		MustCompile()
+
+	tree := re.FindMatchTree("see https://bob@example.com:8080/docs/index.html for details")
+	if tree == nil {
+		t.Fatal("Expected to find a URL")
+	}
+	if tree.Text != "https://bob@example.com:8080/docs/index.html" {
+		t.Errorf("Unexpected whole match %q", tree.Text)
+	}
+	if h, ok := tree.Lookup("authority", "host"); !ok || h.Text != "example.com" || h.Start != 16 {
+		t.Errorf("Lookup(authority, host) = %+v, %v", h, ok)
+	}
+	if _, ok := tree.Lookup("path", "host"); ok {
+		t.Error("Expected no host inside the path")
+	}
+
+	var names []string
+	tree.Walk(func(m *tinyrebuilder.Match, depth int) bool {
+		names = append(names, strings.Repeat(".", depth)+m.Name)
+		return true
+	})
+	want := []string{"", ".scheme", ".authority", "..user", "..host", "..port", ".path"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Walk visited %q; want %q", names, want)
+	}
+	if auth := tree.Children[1]; auth.Name != "authority" || len(auth.Children) != 3 || auth.Index != 2 {
+		t.Errorf("Unexpected authority node %+v", auth)
+	}
+
+	noUser, _ := re.FindMatchTree("http://localhost").Lookup("authority")
+	if len(noUser.Children) != 1 || noUser.Children[0].Name != "host" {
+		t.Errorf("Expected only the host to participate, got %+v", noUser.Children)
+	}
+}
+
+func TestReplaceAllStringMatchesStdlib(t *testing.T) {
+	inputs := randomInputs(5, 200, []string{"a", "b", "ab", "x", " ", "é", "\n", "1"})
+	for _, p := range []string{`a*`, `(a)(b)?`, `x`, `\b`, `(?m)$`, `a|b`, `(?P<d>\d)`} {
+		re := tinyrebuilder.New().Raw(p).MustCompile()
+		std := re.Unwrap()
+		for _, s := range inputs {
+			if got, want := re.ReplaceAllString(s, "<$1>"), std.ReplaceAllString(s, "<$1>"); got != want {
+				t.Fatalf("%s: ReplaceAllString(%q) = %q; want %q", p, s, got, want)
+			}
+			if got, want := re.ReplaceAllLiteralString(s, "$1"), std.ReplaceAllLiteralString(s, "$1"); got != want {
+				t.Fatalf("%s: ReplaceAllLiteralString(%q) = %q; want %q", p, s, got, want)
+			}
+			if got, want := re.ReplaceAllStringFunc(s, strings.ToUpper), std.ReplaceAllStringFunc(s, strings.ToUpper); got != want {
+				t.Fatalf("%s: ReplaceAllStringFunc(%q) = %q; want %q", p, s, got, want)
+			}
+		}
+	}
+}
+
+func TestReplacerTemplates(t *testing.T) {
+	re := tinyrebuilder.New().
+		NamedGroup("key", tinyrebuilder.WordChar().OneOrMore()).
+		NonCapturingGroup(tinyrebuilder.New().Literal("=").NamedGroup("value", tinyrebuilder.Digit().OneOrMore())).Maybe().
+		MustCompile()
+	funcs := tinyrebuilder.TemplateFuncs{
+		"reverse": func(s string) string {
+			r := []rune(s)
+			for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+				r[i], r[j] = r[j], r[i]
+			}
+			return string(r)
+		},
+	}
+	testCases := []struct {
+		template string
+		input    string
+		want     string
+	}{
+		{"${key}:$value", "a=1 b=2", "a:1 b:2"},
+		{"$1/$2", "a=1", "a/1"},
+		{"$$${key}", "a=1", "$a"},
+		{"${key}=${value:-none}", "a=1 b", "a=1 b=none"},
+		{"${value:+set:unset}", "a=1 b", "set unset"},
+		{"${value:+[$value]}", "a=1 b", "[1] "},
+		{`\U${key}\E=$value`, "hello=1", "HELLO=1"},
+		{`\u$key`, "hello world", "Hello World"},
+		{`\L\u$key`, "hELLO", "Hello"},
+		{`${upper(key)}-${reverse(key)}`, "abc", "ABC-cba"},
+		{`${title(key)}`, "hELLO", "Hello"},
+		{`\${key\}`, "a", "${key}"},
+		{`${value:-\U${key}}`, "abc", "ABC"},
+	}
+	for _, tc := range testCases {
+		rp, err := re.NewReplacer(tc.template, funcs)
+		if err != nil {
+			t.Errorf("NewReplacer(%q) failed: %v", tc.template, err)
+			continue
+		}
+		if got := rp.ReplaceAll(tc.input); got != tc.want {
+			t.Errorf("Template %q on %q = %q; want %q", tc.template, tc.input, got, tc.want)
+		}
+	}
+
+	rp, _ := re.NewReplacer(`\U$key`, nil)
+	if got := rp.ReplaceFirst("a=1 b=2"); got != "A b=2" {
+		t.Errorf("ReplaceFirst = %q; want %q", got, "A b=2")
+	}
+
+	for _, bad := range []string{"${missing}", "$missing", "${nope(key)}", "${key", "${key:+x", "${}", "${key:x}", "$9"} {
+		if _, err := re.NewReplacer(bad, nil); err == nil {
+			t.Errorf("Expected an error for template %q", bad)
+		}
+	}
+}
+
+func TestMultiReplacer(t *testing.T) {
+	mr, err := tinyrebuilder.NewMultiReplacer(
+		tinyrebuilder.LiteralRule(tinyrebuilder.New().Literal("cat"), "dog"),
+		tinyrebuilder.LiteralRule(tinyrebuilder.New().Literal("dog"), "cat"),
+		tinyrebuilder.TemplateRule(tinyrebuilder.New().
+			NamedGroup("key", tinyrebuilder.WordChar().OneOrMore()).
+			Literal("=").
+			NamedGroup("value", tinyrebuilder.Digit().OneOrMore()), `\U$key\E:$value`, nil),
+		tinyrebuilder.FuncRule(tinyrebuilder.New().Digit().OneOrMore(), func(s string) string {
+			return strings.Repeat("#", len(s))
+		}),
+	)
+	if err != nil {
+		t.Fatalf("NewMultiReplacer failed: %v", err)
+	}
+	testCases := []struct {
+		input string
+		want  string
+	}{
+		{"cat and dog", "dog and cat"},
+		{"id=42 pin 1234", "ID:42 pin ####"},
+		{"no matches here", "no matches here"},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		if got := mr.Replace(tc.input); got != tc.want {
+			t.Errorf("Replace(%q) = %q; want %q", tc.input, got, tc.want)
+		}
+	}
+
+	// With non-overlapping patterns, a single pass agrees with applying each
+	// replacement in turn.
+	patterns := []string{`\d+`, `[A-Z]{2,}`, `\s{2,}`}
+	var rules []tinyrebuilder.ReplaceRule
+	for _, p := range patterns {
+		rules = append(rules, tinyrebuilder.LiteralRule(tinyrebuilder.New().Raw(p), "_"))
+	}
+	mr, err = tinyrebuilder.NewMultiReplacer(rules...)
+	if err != nil {
+		t.Fatalf("NewMultiReplacer failed: %v", err)
+	}
+	for _, input := range []string{"ABC 123  def", "x1y22  ZZ top", "  ", "plain"} {
+		want := input
+		for _, p := range patterns {
+			want = regexp.MustCompile(p).ReplaceAllString(want, "_")
+		}
+		if got := mr.Replace(input); got != want {
+			t.Errorf("Replace(%q) = %q; sequential = %q", input, got, want)
+		}
+	}
+}
+
+func TestMultiReplacerMatchesAlternation(t *testing.T) {
+	// A MultiReplacer replaces exactly what the alternation of its rules
+	// matches, including rules with assertions and empty matches.
+	ruleSets := [][]string{
+		{`\bcat\b`, `ca`, `a*`},
+		{`^\w+`, `\d+$`, `x`},
+		{`(?m)^\s*`, `o+`},
+		{`(a)(b)?`, `b`, `$`},
+	}
+	for _, set := range ruleSets {
+		var rules []tinyrebuilder.ReplaceRule
+		for i, p := range set {
+			rules = append(rules, tinyrebuilder.LiteralRule(tinyrebuilder.New().Raw(p), fmt.Sprintf("<%d>", i)))
+		}
+		mr, err := tinyrebuilder.NewMultiReplacer(rules...)
+		if err != nil {
+			t.Fatalf("NewMultiReplacer(%q) failed: %v", set, err)
+		}
+		// Each alternative is captured, so the rule that matched is the
+		// first one whose capture participated.
+		var alts []string
+		var offsets []int
+		group := 1
+		for _, p := range set {
+			alts = append(alts, "("+p+")")
+			offsets = append(offsets, group)
+			group += regexp.MustCompile(p).NumSubexp() + 1
+		}
+		combined := regexp.MustCompile(strings.Join(alts, "|"))
+		for _, input := range append(randomInputs(7, 50, []string{"a", "b", "cat", "x", "o", " ", "1", "2", "\n"}), "cat scat 42", "ab\nb") {
+			var want strings.Builder
+			last := 0
+			for _, loc := range combined.FindAllStringSubmatchIndex(input, -1) {
+				want.WriteString(input[last:loc[0]])
+				for i, off := range offsets {
+					if loc[2*off] >= 0 {
+						fmt.Fprintf(&want, "<%d>", i)
+						break
+					}
+				}
+				last = loc[1]
+			}
+			want.WriteString(input[last:])
+			if got := mr.Replace(input); got != want.String() {
+				t.Errorf("Rules %q on %q = %q; want %q", set, input, got, want.String())
+			}
+		}
+	}
+}
+
+func TestMultiReplacerPriority(t *testing.T) {
+	short := tinyrebuilder.LiteralRule(tinyrebuilder.New().Literal("foo"), "<short>")
+	long := tinyrebuilder.LiteralRule(tinyrebuilder.New().Literal("foobar"), "<long>")
+
+	mr, _ := tinyrebuilder.NewMultiReplacer(short, long)
+	if got := mr.Replace("foobar"); got != "<short>bar" {
+		t.Errorf("Equal priority: got %q; want the first rule to win", got)
+	}
+	mr, _ = tinyrebuilder.NewMultiReplacer(short, long.WithPriority(1))
+	if got := mr.Replace("foobar foo"); got != "<long> <short>" {
+		t.Errorf("Higher priority: got %q; want %q", got, "<long> <short>")
+	}
+	// Priority only breaks ties: the leftmost match still wins.
+	mr, _ = tinyrebuilder.NewMultiReplacer(short, tinyrebuilder.LiteralRule(tinyrebuilder.New().Literal("xfoo"), "<x>").WithPriority(-1))
+	if got := mr.Replace("xfoo"); got != "<x>" {
+		t.Errorf("Leftmost: got %q; want %q", got, "<x>")
+	}
+
+	if _, err := tinyrebuilder.NewMultiReplacer(tinyrebuilder.LiteralRule(tinyrebuilder.New().Raw("("), "")); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+	if _, err := tinyrebuilder.NewMultiReplacer(tinyrebuilder.TemplateRule(tinyrebuilder.New().Literal("a"), "$missing", nil)); err == nil {
+		t.Error("Expected an error for an invalid template")
+	}
+}
+
+func BenchmarkMultiReplacer(b *testing.B) {
+	var rules []tinyrebuilder.ReplaceRule
+	var sequential []*regexp.Regexp
+	for i := 0; i < 20; i++ {
+		word := fmt.Sprintf("secret%02d", i)
+		rules = append(rules, tinyrebuilder.LiteralRule(tinyrebuilder.New().Literal(word), "***"))
+		sequential = append(sequential, regexp.MustCompile(regexp.QuoteMeta(word)))
+	}
+	mr, err := tinyrebuilder.NewMultiReplacer(rules...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	input := strings.Repeat("some log text mentioning secret07 and secret13 among other words\n", 100)
+
+	b.Run("MultiReplacer", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			_ = mr.Replace(input)
+		}
+	})
+	b.Run("Sequential", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			s := input
+			for _, re := range sequential {
+				s = re.ReplaceAllString(s, "***")
+			}
+		}
+	})
+}
+
+func TestContextMethodsMatchStdlib(t *testing.T) {
+	inputs := randomInputs(3, 200, []string{"a", "b", "c", "d", "x", "=", "1", " ", "\n", "é", "Ä"})
+	ctx := context.Background()
+	for _, p := range machinePatterns {
+		re := tinyrebuilder.New().Raw(p).MustCompile()
+		std := re.Unwrap()
+		for _, s := range inputs {
+			matched, err := re.MatchStringContext(ctx, s)
+			if err != nil || matched != std.MatchString(s) {
+				t.Fatalf("%s: MatchStringContext(%q) = %v, %v; want %v", p, s, matched, err, std.MatchString(s))
+			}
+			idx, err := re.FindAllStringIndexContext(ctx, s, -1)
+			if want := std.FindAllStringIndex(s, -1); err != nil || !reflect.DeepEqual(idx, want) {
+				t.Fatalf("%s: FindAllStringIndexContext(%q) = %v, %v; want %v", p, s, idx, err, want)
+			}
+			subs, err := re.FindAllStringSubmatchContext(ctx, s, 3)
+			if want := std.FindAllStringSubmatch(s, 3); err != nil || !reflect.DeepEqual(subs, want) {
+				t.Fatalf("%s: FindAllStringSubmatchContext(%q) = %v, %v; want %v", p, s, subs, err, want)
+			}
+			got, err := re.ReplaceAllStringContext(ctx, s, "<$1>")
+			if want := std.ReplaceAllString(s, "<$1>"); err != nil || got != want {
+				t.Fatalf("%s: ReplaceAllStringContext(%q) = %q, %v; want %q", p, s, got, err, want)
+			}
+		}
+	}
+}
+
+// countdownContext reports cancellation once Err has been called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestContextCancellationAndLimits(t *testing.T) {
+	re := tinyrebuilder.New().
+		NamedGroup("word", tinyrebuilder.WordChar().OneOrMore()).
+		Literal("!").
+		MustCompile()
+	input := strings.Repeat("word ", 1<<18) + "done!"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := re.MatchStringContext(ctx, input); !errors.Is(err, context.Canceled) {
+		t.Errorf("Cancelled context: got %v; want context.Canceled", err)
+	}
+
+	// The context is consulted again during the scan, not only up front.
+	cd := &countdownContext{Context: context.Background(), n: 2}
+	if _, err := re.FindAllStringContext(cd, input, -1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Cancelled mid-scan: got %v; want context.Canceled", err)
+	}
+	if got, err := re.FindAllStringContext(context.Background(), input, -1); err != nil || len(got) != 1 || got[0] != "done!" {
+		t.Errorf("FindAllStringContext = %v, %v; want [done!]", got, err)
+	}
+
+	// Dense matches, each far shorter than the interval between checks,
+	// are cancelled too.
+	dense := tinyrebuilder.New().Literal("a").MustCompile()
+	as := strings.Repeat("a", 20<<20)
+	cd = &countdownContext{Context: context.Background(), n: 2}
+	if _, err := dense.FindAllStringContext(cd, as, -1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Cancelled among dense matches: got %v; want context.Canceled", err)
+	}
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	start := time.Now()
+	if _, err := dense.FindAllStringContext(timeout, as, -1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Timed out among dense matches: got %v; want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("FindAllStringContext took %v to notice its deadline", elapsed)
+	}
+
+	limited := re.WithLimits(tinyrebuilder.Limits{MaxInputSize: 1024, MaxMatches: 2})
+	if _, err := limited.MatchStringContext(context.Background(), input); !errors.Is(err, tinyrebuilder.ErrInputTooLarge) {
+		t.Errorf("Large input: got %v; want ErrInputTooLarge", err)
+	}
+	got, err := limited.FindAllStringContext(context.Background(), "a! b! c! d!", -1)
+	if err != nil || !reflect.DeepEqual(got, []string{"a!", "b!"}) {
+		t.Errorf("MaxMatches: got %v, %v; want [a! b!]", got, err)
+	}
+	if got, _ := limited.ReplaceAllStringContext(context.Background(), "a! b! c!", "-"); got != "- - c!" {
+		t.Errorf("MaxMatches replace: got %q; want %q", got, "- - c!")
+	}
+	if re.Limits() != (tinyrebuilder.Limits{}) {
+		t.Errorf("WithLimits modified the original Regexp: %+v", re.Limits())
+	}
+}
+
+func TestCompileUntrusted(t *testing.T) {
+	re, err := tinyrebuilder.CompileUntrusted(tinyrebuilder.New().
+		StartAnchor().
+		NamedGroup("user", tinyrebuilder.WordChar().Between(1, 32)).
+		Literal("@").
+		GroupWithFlags("i", tinyrebuilder.New().Literal("example.com")), tinyrebuilder.DefaultUntrustedPolicy)
+	if err != nil {
+		t.Fatalf("CompileUntrusted rejected a compliant pattern: %v", err)
+	}
+	if !re.MatchString("bob@EXAMPLE.com") {
+		t.Error("Expected the compiled pattern to match")
+	}
+
+	testCases := []struct {
+		pattern string
+		policy  tinyrebuilder.CompilePolicy
+		rules   []string
+	}{
+		{strings.Repeat("a", 2000), tinyrebuilder.DefaultUntrustedPolicy, []string{"MaxPatternLength"}},
+		{`a{500}`, tinyrebuilder.DefaultUntrustedPolicy, []string{"MaxRepeat"}},
+		{`((((((((((((a))))))))))))`, tinyrebuilder.DefaultUntrustedPolicy, []string{"MaxNestingDepth"}},
+		{`(a)(b)(c)`, tinyrebuilder.CompilePolicy{MaxCaptureGroups: 2}, []string{"MaxCaptureGroups"}},
+		{`(?:abc){50}`, tinyrebuilder.CompilePolicy{MaxProgramSize: 100}, []string{"MaxProgramSize"}},
+		{`(?m)^x$`, tinyrebuilder.CompilePolicy{RestrictFlags: true, AllowedFlags: "i"}, []string{"AllowedFlags"}},
+		{`[(?m)]\Q(?s)\E(?P<n>x)(?i:y)`, tinyrebuilder.CompilePolicy{RestrictFlags: true, AllowedFlags: "i"}, nil},
+		{`a\Cb`, tinyrebuilder.DefaultUntrustedPolicy, []string{"ForbidAnyByte"}},
+		{`.*secret`, tinyrebuilder.DefaultUntrustedPolicy, []string{"ForbidLeadingWildcard"}},
+		{`(x|.+)y`, tinyrebuilder.DefaultUntrustedPolicy, []string{"ForbidLeadingWildcard"}},
+		{`^.*secret`, tinyrebuilder.DefaultUntrustedPolicy, nil},
+		{`(?s).*(a`, tinyrebuilder.CompilePolicy{RestrictFlags: true, AllowedFlags: "i"}, []string{"AllowedFlags", "Syntax"}},
+		{`(?x).*(a){200}`, tinyrebuilder.DefaultUntrustedPolicy, []string{"Syntax"}},
+		{`.*a{200}`, tinyrebuilder.DefaultUntrustedPolicy, []string{"MaxRepeat", "ForbidLeadingWildcard"}},
+	}
+	for _, tc := range testCases {
+		var rules []string
+		for _, v := range tc.policy.Check(tc.pattern) {
+			rules = append(rules, v.Rule)
+		}
+		if !reflect.DeepEqual(rules, tc.rules) {
+			t.Errorf("Check(%.40q) violated %v; want %v", tc.pattern, rules, tc.rules)
+		}
+	}
+
+	// Unicode word boundaries are neither capture groups nor text.
+	bounded := tinyrebuilder.New().UnicodeWordBoundary().Literal("word").UnicodeWordBoundary().Build()
+	if v := (tinyrebuilder.CompilePolicy{MaxCaptureGroups: 1, MaxNestingDepth: 1}).Check(bounded); v != nil {
+		t.Errorf("Check of a pattern with two Unicode word boundaries violated %v; want none", v)
+	}
+	wildcard := tinyrebuilder.New().UnicodeWordBoundary().Raw(`.*secret`).Build()
+	if v := tinyrebuilder.DefaultUntrustedPolicy.Check(wildcard); len(v) != 1 || v[0].Rule != "ForbidLeadingWildcard" {
+		t.Errorf("Check of a wildcard after a Unicode word boundary violated %v; want ForbidLeadingWildcard", v)
+	}
+
+	_, err = tinyrebuilder.CompileUntrusted(tinyrebuilder.New().Raw(`.*a{500}`), tinyrebuilder.DefaultUntrustedPolicy)
+	var policyErr *tinyrebuilder.PolicyError
+	if !errors.As(err, &policyErr) || len(policyErr.Violations) != 2 {
+		t.Fatalf("Expected a PolicyError with two violations, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "MaxRepeat") || !strings.Contains(err.Error(), "ForbidLeadingWildcard") {
+		t.Errorf("Error message should name every violated rule: %v", err)
+	}
+}
+
+// batchRecords returns n generated records, every third of which holds an
+// email address.
+func batchRecords(n int) []string {
+	records := make([]string, n)
+	for i := range records {
+		if i%3 == 0 {
+			records[i] = fmt.Sprintf("id=%d contact=user%d@example.com status=ok", i, i)
+		} else {
+			records[i] = fmt.Sprintf("id=%d contact=none status=pending", i)
+		}
+	}
+	return records
+}
+
+func TestMatchBatch(t *testing.T) {
+	re := findEmail().MustCompile()
+	records := batchRecords(5000)
+	for _, workers := range []int{0, 1, 3, 16} {
+		got := re.MatchBatch(records, workers)
+		found := re.FindBatch(records, workers)
+		for i, s := range records {
+			if got[i] != re.MatchString(s) {
+				t.Fatalf("workers=%d: MatchBatch[%d] = %v; want %v", workers, i, got[i], !got[i])
+			}
+			if want := re.FindStringSubmatch(s); !reflect.DeepEqual(found[i], want) {
+				t.Fatalf("workers=%d: FindBatch[%d] = %q; want %q", workers, i, found[i], want)
+			}
+		}
+	}
+
+	_, stats, err := re.MatchBatchContext(context.Background(), records, 4)
+	if err != nil || stats.Inputs != 5000 || stats.Matched != 1667 {
+		t.Errorf("MatchBatchContext stats = %+v, %v; want 5000 inputs, 1667 matched", stats, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := re.FindBatchContext(ctx, records, 4); !errors.Is(err, context.Canceled) {
+		t.Errorf("Cancelled FindBatchContext: got %v; want context.Canceled", err)
+	}
+	if got := re.MatchBatch(nil, 4); len(got) != 0 {
+		t.Errorf("MatchBatch(nil) = %v; want empty", got)
+	}
+}
+
+func TestRegexpSetMatchBatch(t *testing.T) {
+	set := tinyrebuilder.NewRegexpSet(
+		findEmail().MustCompile(),
+		tinyrebuilder.New().Literal("status=ok").MustCompile(),
+		tinyrebuilder.New().Literal("id=1").Digit().OneOrMore().MustCompile(),
+	)
+	records := batchRecords(3000)
+	got, stats, err := set.MatchBatchContext(context.Background(), records, 0)
+	if err != nil {
+		t.Fatalf("MatchBatchContext failed: %v", err)
+	}
+	for i, s := range records {
+		if want := set.MatchString(s); !reflect.DeepEqual(got[i], want) {
+			t.Fatalf("MatchBatch[%d] = %v; want %v", i, got[i], want)
+		}
+	}
+	if stats.Matched != 1741 || stats.PerPattern[0] != 1000 || stats.PerPattern[1] != 1000 || stats.PerPattern[2] != 1110 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func BenchmarkMatchBatch(b *testing.B) {
+	re := findEmail().MustCompile()
+	records := batchRecords(100000)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = re.MatchBatch(records, workers)
+			}
+		})
+	}
+}
+
+// scanLinesSequential is the reference result for ScanFile.
+func scanLinesSequential(data string, re *tinyrebuilder.Regexp) []tinyrebuilder.LineMatch {
+	var out []tinyrebuilder.LineMatch
+	offset := 0
+	for i, line := range strings.SplitAfter(data, "\n") {
+		if line == "" {
+			break
+		}
+		text := strings.TrimSuffix(line, "\n")
+		if locs := re.FindAllStringIndex(text, -1); locs != nil {
+			out = append(out, tinyrebuilder.LineMatch{Line: i + 1, Offset: int64(offset), Text: text, Matches: locs})
+		}
+		offset += len(line)
+	}
+	return out
+}
+
+func TestScanFile(t *testing.T) {
+	re := tinyrebuilder.New().Literal("ERROR ").NamedGroup("code", tinyrebuilder.Digit().OneOrMore()).MustCompile()
+	var sb strings.Builder
+	rng := rand.New(rand.NewSource(5))
+	for i := 0; i < 3000; i++ {
+		switch rng.Intn(10) {
+		case 0:
+			fmt.Fprintf(&sb, "line %d ERROR %d and ERROR %d\n", i, rng.Intn(500), rng.Intn(500))
+		case 1:
+			fmt.Fprintf(&sb, "%s ERROR %d\n", strings.Repeat("x", 5000), i)
+		case 2:
+			sb.WriteString("\n")
+		default:
+			fmt.Fprintf(&sb, "line %d INFO ok\n", i)
+		}
+	}
+	sb.WriteString("last line ERROR 7 without newline")
+	data := sb.String()
+	path := t.TempDir() + "/scan.log"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := scanLinesSequential(data, re)
+	for _, opts := range []tinyrebuilder.ScanOptions{
+		{AllMatches: true},
+		{Workers: 1, ChunkSize: 97, AllMatches: true},
+		{Workers: 4, ChunkSize: 1000, AllMatches: true},
+		{Workers: 3, ChunkSize: 64 << 10, AllMatches: true},
+	} {
+		got, err := tinyrebuilder.ScanFile(path, re, opts)
+		if err != nil {
+			t.Fatalf("ScanFile(%+v) failed: %v", opts, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("ScanFile(%+v) returned %d lines; want %d matching the sequential scan", opts, len(got), len(want))
+		}
+	}
+
+	got, err := tinyrebuilder.ScanFile(path, re, tinyrebuilder.ScanOptions{ChunkSize: 512})
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("ScanFile returned %d lines, %v; want %d", len(got), err, len(want))
+	}
+	for i := range got {
+		if len(got[i].Matches) != 1 || !reflect.DeepEqual(got[i].Matches[0], want[i].Matches[0]) {
+			t.Fatalf("Line %d: got matches %v; want only the leftmost of %v", got[i].Line, got[i].Matches, want[i].Matches)
+		}
+	}
+
+	// Scan works on any io.ReaderAt and stops when the callback fails.
+	stopErr := errors.New("stop")
+	calls := 0
+	err = tinyrebuilder.Scan(strings.NewReader(data), int64(len(data)), re, tinyrebuilder.ScanOptions{Workers: 4, ChunkSize: 256}, func(m tinyrebuilder.LineMatch) error {
+		if calls++; calls == 10 {
+			return stopErr
+		}
+		return nil
+	})
+	if !errors.Is(err, stopErr) || calls != 10 {
+		t.Errorf("Scan = %v after %d calls; want the callback error after 10 calls", err, calls)
+	}
+
+	if got, err := tinyrebuilder.ScanFile(t.TempDir()+"/missing", re, tinyrebuilder.ScanOptions{}); err == nil || got != nil {
+		t.Errorf("Expected an error for a missing file, got %v", got)
+	}
+	empty := t.TempDir() + "/empty"
+	os.WriteFile(empty, nil, 0o644)
+	if got, err := tinyrebuilder.ScanFile(empty, re, tinyrebuilder.ScanOptions{}); err != nil || got != nil {
+		t.Errorf("ScanFile(empty) = %v, %v; want nothing", got, err)
+	}
+}
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read atomic.Int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// TestScanLongLine scans lines that span thousands of chunks, which must not
+// make the chunks search the line for its end over and over.
+func TestScanLongLine(t *testing.T) {
+	re := tinyrebuilder.New().Literal("ERROR ").Digit().OneOrMore().MustCompile()
+	long := strings.Repeat("x", 1<<20)
+	data := "ERROR 1\n" + long + " ERROR 2 " + long + "\nok\n" + long + "\nERROR 3"
+	r := &countingReaderAt{r: strings.NewReader(data)}
+	var got []tinyrebuilder.LineMatch
+	err := tinyrebuilder.Scan(r, int64(len(data)), re, tinyrebuilder.ScanOptions{Workers: 4, ChunkSize: 256}, func(m tinyrebuilder.LineMatch) error {
+		got = append(got, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := scanLinesSequential(data, re); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Scan returned %d lines; want %d matching the sequential scan", len(got), len(want))
+	}
+	// Each byte is read once to find the chunk boundaries and once to scan
+	// its chunk.
+	if read := r.read.Load(); read > 3*int64(len(data)) {
+		t.Errorf("Scan read %d bytes of a %d-byte input", read, len(data))
+	}
+}
+
+// levenshtein returns the edit distance between a and b, counted in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func TestCompileFuzzyMatchesEditDistance(t *testing.T) {
+	inputs := randomInputs(11, 300, []string{"c", "o", "l", "r", "u", "x", " ", "é"})
+	for _, word := range []string{"color", "col", "éco"} {
+		for k := 0; k <= 2; k++ {
+			fz, err := tinyrebuilder.CompileFuzzy(tinyrebuilder.New().Literal(word), k)
+			if err != nil {
+				t.Fatalf("CompileFuzzy(%q) failed: %v", word, err)
+			}
+			for _, s := range inputs {
+				// The best match has the fewest edits, then the leftmost
+				// start, then the longest extent.
+				want := tinyrebuilder.FuzzyMatch{Start: -1}
+				for i := 0; i <= len(s); i++ {
+					for j := len(s); j >= i; j-- {
+						if i < len(s) && !utf8.RuneStart(s[i]) || j < len(s) && !utf8.RuneStart(s[j]) {
+							continue
+						}
+						d := levenshtein(s[i:j], word)
+						if d <= k && (want.Start < 0 || d < want.Edits || d == want.Edits && i < want.Start) {
+							want = tinyrebuilder.FuzzyMatch{Start: i, End: j, Text: s[i:j], Edits: d}
+						}
+					}
+				}
+				got, ok := fz.FindString(s)
+				if ok != (want.Start >= 0) || ok && got != want {
+					t.Fatalf("%q k=%d: FindString(%q) = %+v, %v; want %+v", word, k, s, got, ok, want)
+				}
+				if fz.MatchString(s) != ok {
+					t.Fatalf("%q k=%d: MatchString(%q) disagrees with FindString", word, k, s)
+				}
+			}
+		}
+	}
+}
+
+func TestCompileFuzzy(t *testing.T) {
+	fz, err := tinyrebuilder.CompileFuzzy(tinyrebuilder.New().
+		WordBoundary().
+		Literal("invoice").
+		Whitespace().
+		Literal("#").
+		Digit().Exactly(4), 2)
+	if err != nil {
+		t.Fatalf("CompileFuzzy failed: %v", err)
+	}
+	testCases := []struct {
+		input string
+		text  string
+		edits int
+	}{
+		{"see invoice #1234 attached", "invoice #1234", 0},
+		{"see lnvoice #1234 attached", "lnvoice #1234", 1},
+		{"see invoce #12E4 attached", "invoce #12E4", 2},
+		{"see invoice#1234 attached", "invoice#1234", 1},
+	}
+	for _, tc := range testCases {
+		m, ok := fz.FindString(tc.input)
+		if !ok || m.Text != tc.text || m.Edits != tc.edits {
+			t.Errorf("FindString(%q) = %+v, %v; want %q with %d edits", tc.input, m, ok, tc.text, tc.edits)
+		}
+	}
+	if fz.MatchString("see receipt #1234") {
+		t.Error("Expected no match beyond the edit budget")
+	}
+
+	words, _ := tinyrebuilder.CompileFuzzy(tinyrebuilder.New().Literal("color"), 1)
+	var got []string
+	for _, m := range words.FindAllString("colour, color and colr but not clr", -1) {
+		got = append(got, fmt.Sprintf("%s/%d", m.Text, m.Edits))
+	}
+	if want := []string{"colour/1", "color/0", "colr/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAllString = %v; want %v", got, want)
+	}
+	if n := len(words.FindAllString("color color color", 2)); n != 2 {
+		t.Errorf("FindAllString with n=2 returned %d matches", n)
+	}
+
+	if _, err := tinyrebuilder.CompileFuzzy(tinyrebuilder.New().Raw("("), 1); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+	if _, err := tinyrebuilder.CompileFuzzy(tinyrebuilder.New().Literal("a"), -1); err == nil {
+		t.Error("Expected an error for a negative edit budget")
+	}
+}
+
+func TestUnicodeWordBoundary(t *testing.T) {
+	re := tinyrebuilder.New().
+		UnicodeWordBoundary().
+		Group(tinyrebuilder.New().Literal("café")).
+		UnicodeWordBoundary().
+		MustCompile()
+	// \b treats é as a non-word character, so it wrongly sees a boundary
+	// inside "cafés".
+	ascii := tinyrebuilder.New().WordBoundary().Literal("café").WordBoundary().MustCompile()
+	if !ascii.MatchString("cafés") {
+		t.Fatal("Expected the ASCII word boundary to match inside cafés")
+	}
+	testCases := []struct {
+		input string
+		want  bool
+	}{
+		{"un café noir", true},
+		{"café", true},
+		{"cafés", false},
+		{"décafé", false},
+		{"café_", false},
+		{"(café)", true},
+		{"café́", false},
+	}
+	for _, tc := range testCases {
+		if got := re.MatchString(tc.input); got != tc.want {
+			t.Errorf("MatchString(%q) = %v; want %v", tc.input, got, tc.want)
+		}
+		if got := re.FindString(tc.input) != ""; got != tc.want {
+			t.Errorf("FindString(%q) found = %v; want %v", tc.input, got, tc.want)
+		}
+	}
+
+	if re.NumSubexp() != 1 || len(re.SubexpNames()) != 2 {
+		t.Errorf("Markers leaked into the groups: NumSubexp() = %d, SubexpNames() = %q", re.NumSubexp(), re.SubexpNames())
+	}
+	input := "café, cafés et café"
+	if got := re.FindAllStringIndex(input, -1); !reflect.DeepEqual(got, [][]int{{0, 5}, {17, 22}}) {
+		t.Errorf("FindAllStringIndex = %v", got)
+	}
+	if got := re.ReplaceAllString(input, "[$1]"); got != "[café], cafés et [café]" {
+		t.Errorf("ReplaceAllString = %q", got)
+	}
+	if got := re.FindStringSubmatch("un café"); !reflect.DeepEqual(got, []string{"café", "café"}) {
+		t.Errorf("FindStringSubmatch = %q", got)
+	}
+
+	if tree := re.FindMatchTree("cafés, café"); tree == nil || tree.Start != 8 || len(tree.Children) != 1 {
+		t.Errorf("FindMatchTree = %+v; want the second café with one group", tree)
+	}
+
+	inner := tinyrebuilder.New().NotUnicodeWordBoundary().Literal("é").MustCompile()
+	if got := inner.FindAllString("été café é", -1); !reflect.DeepEqual(got, []string{"é", "é"}) {
+		t.Errorf("NotUnicodeWordBoundary FindAllString = %q; want the two é inside words", got)
+	}
+
+	cached := tinyrebuilder.New().UnicodeWordBoundary().Literal("naïve").UnicodeWordBoundary().MustCompileWithCache()
+	if !cached.MatchString("a naïve idea") || cached.MatchString("naïveté") {
+		t.Error("Cached pattern does not enforce Unicode word boundaries")
+	}
+}
+
+func TestUnicodeWordBoundaryMatchesASCIIBoundary(t *testing.T) {
+	// On ASCII input the Unicode boundary agrees with \b.
+	inputs := randomInputs(13, 300, []string{"a", "b", "1", "_", " ", "-", "ab", "\n"})
+	for _, p := range []string{`\bab?\b`, `\b`, `\B\w+\b`, `(\w+)\b-\b(\w*)`, `x*\B`} {
+		want := regexp.MustCompile(p)
+		b := tinyrebuilder.New()
+		for i := 0; i < len(p); i++ {
+			switch {
+			case strings.HasPrefix(p[i:], `\b`):
+				b.UnicodeWordBoundary()
+				i++
+			case strings.HasPrefix(p[i:], `\B`):
+				b.NotUnicodeWordBoundary()
+				i++
+			default:
+				b.Raw(p[i : i+1])
+			}
+		}
+		re := b.MustCompile()
+		for _, s := range inputs {
+			if got := re.FindAllStringSubmatch(s, -1); !reflect.DeepEqual(got, want.FindAllStringSubmatch(s, -1)) {
+				t.Fatalf("%s: FindAllStringSubmatch(%q) = %q; want %q", p, s, got, want.FindAllStringSubmatch(s, -1))
+			}
+			if got := re.FindAllStringIndex(s, -1); !reflect.DeepEqual(got, want.FindAllStringIndex(s, -1)) {
+				t.Fatalf("%s: FindAllStringIndex(%q) = %v; want %v", p, s, got, want.FindAllStringIndex(s, -1))
+			}
+			if got := re.MatchString(s); got != want.MatchString(s) {
+				t.Fatalf("%s: MatchString(%q) = %v", p, s, got)
+			}
+		}
+	}
+}
+
+func TestByteMode(t *testing.T) {
+	png := tinyrebuilder.NewBytes().
+		StartOfString().
+		Literal("\x89PNG\r\n\x1a\n").
+		MustCompileBytes()
+	if !png.Match([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")) || png.Match([]byte("PNG\r\n")) {
+		t.Error("Byte-mode literal does not match the PNG signature")
+	}
+
+	// A length-prefixed record: a tag byte, a length byte, and a payload of
+	// high bytes that is not valid UTF-8.
+	record := tinyrebuilder.NewBytes().
+		AnyOf("\x01\x02").
+		Group(tinyrebuilder.New().Range(0x00, 0x7f)).
+		Group(tinyrebuilder.NewBytes().Range(0x80, 0xff).OneOrMore()).
+		MustCompileBytes()
+	input := []byte("junk\x02\x03\xfe\xff\x80junk\x01\x00\xc3")
+	got := record.FindAllSubmatch(input, -1)
+	want := [][][]byte{
+		{[]byte("\x02\x03\xfe\xff\x80"), []byte("\x03"), []byte("\xfe\xff\x80")},
+		{[]byte("\x01\x00\xc3"), []byte("\x00"), []byte("\xc3")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindAllSubmatch = %q; want %q", got, want)
+	}
+	if got := record.ReplaceAll(input, []byte("<$2>")); string(got) != "junk<\xfe\xff\x80>junk<\xc3>" {
+		t.Errorf("ReplaceAll = %q", got)
+	}
+
+	// \xc3\xa9 is "é" in UTF-8 but two separate bytes here.
+	dot := tinyrebuilder.NewBytes().Raw(".").MustCompileBytes()
+	if got := dot.FindAll([]byte("\xc3\xa9"), -1); len(got) != 2 {
+		t.Errorf("FindAll(.) = %q; want each byte on its own", got)
+	}
+	notA := tinyrebuilder.NewBytes().NotAnyOf("a\xe9").OneOrMore().MustCompileBytes()
+	if got := notA.FindAll([]byte("b\xe8a\xe9\xc3\xa9"), -1); !reflect.DeepEqual(got, [][]byte{[]byte("b\xe8"), []byte("\xc3\xa9")}) {
+		t.Errorf("NotAnyOf FindAll = %q", got)
+	}
+
+	latin1, err := tinyrebuilder.ToLatin1("café")
+	if err != nil || latin1 != "caf\xe9" {
+		t.Fatalf("ToLatin1(café) = %q, %v", latin1, err)
+	}
+	word := tinyrebuilder.NewBytes().
+		WithFlags("i").
+		UnicodeWordBoundary().
+		Literal(latin1).
+		UnicodeWordBoundary().
+		MustCompileBytes()
+	if got := word.FindAllIndex([]byte("CAF\xc9 caf\xe9s caf\xe9"), -1); !reflect.DeepEqual(got, [][]int{{0, 4}, {11, 15}}) {
+		t.Errorf("Latin-1 FindAllIndex = %v", got)
+	}
+	if word.Match([]byte("café")) {
+		t.Error("Latin-1 pattern matched UTF-8 text")
+	}
+
+	// A pattern stored in Latin-1 is decoded before it is written to the builder.
+	stored := []byte("na\xefve|gar\xe7on")
+	legacy := tinyrebuilder.NewBytes().Raw(tinyrebuilder.FromLatin1(stored)).MustCompileBytes()
+	if got := legacy.FindAll([]byte("un gar\xe7on na\xefve"), -1); !reflect.DeepEqual(got, [][]byte{[]byte("gar\xe7on"), []byte("na\xefve")}) {
+		t.Errorf("Legacy pattern FindAll = %q", got)
+	}
+
+	var latinErr *tinyrebuilder.Latin1Error
+	if _, err := tinyrebuilder.ToLatin1("€uro"); !errors.As(err, &latinErr) || latinErr.Rune != '€' || latinErr.Offset != 0 {
+		t.Errorf("ToLatin1(€uro) error = %v; want a Latin1Error for €", err)
+	}
+	if _, err := tinyrebuilder.ToLatin1("ok\xff"); !errors.As(err, &latinErr) || latinErr.Offset != 2 {
+		t.Errorf("ToLatin1 of invalid UTF-8 error = %v", err)
+	}
+	if got := tinyrebuilder.FromLatin1([]byte("caf\xe9\xff")); got != "caféÿ" {
+		t.Errorf("FromLatin1 = %q", got)
+	}
+}
+
+func TestByteModeMatchesLatin1Stdlib(t *testing.T) {
+	// Matching bytes is the same as matching their Latin-1 decoding with the
+	// standard library, once offsets are mapped back to bytes.
+	inputs := randomInputs(17, 300, []string{"a", "b", "_", " ", "\n", "\x00", "\xc3", "\xa9", "\xe9", "\xc9", "\xff"})
+	patterns := []*tinyrebuilder.RegexBuilder{
+		tinyrebuilder.NewBytes().Literal("\xc3\xa9"),
+		tinyrebuilder.NewBytes().Range(0x80, 0xff).OneOrMore(),
+		tinyrebuilder.NewBytes().WithFlags("i").Literal("\xe9a"),
+		tinyrebuilder.NewBytes().WordChar().OneOrMore(),
+		tinyrebuilder.NewBytes().NotAnyOf("a\n").ZeroOrMore(),
+		tinyrebuilder.NewBytes().WordBoundary(),
+		tinyrebuilder.NewBytes().Raw(`(?s).`).Maybe().Group(tinyrebuilder.NewBytes().AnyOf("\xff\x00")),
+		tinyrebuilder.NewBytes().Raw(`(?m)^`).Group(tinyrebuilder.NewBytes().Raw(`\pL+`)).Raw(`$`),
+	}
+	for _, b := range patterns {
+		expr := b.Build()
+		want := regexp.MustCompile(expr)
+		re := b.MustCompileBytes()
+		for _, s := range inputs {
+			text := tinyrebuilder.FromLatin1([]byte(s))
+			offsets := make([]int, len(text)+1)
+			for i, n := 0, 0; i <= len(text); i++ {
+				offsets[i] = n
+				if i < len(text) && utf8.RuneStart(text[i]) {
+					n++
+				}
+			}
+			offsets[len(text)] = len(s)
+			var wantLocs [][]int
+			for _, loc := range want.FindAllStringSubmatchIndex(text, -1) {
+				mapped := make([]int, len(loc))
+				for i, off := range loc {
+					mapped[i] = -1
+					if off >= 0 {
+						mapped[i] = offsets[off]
+					}
+				}
+				wantLocs = append(wantLocs, mapped)
+			}
+			if got := re.FindAllSubmatchIndex([]byte(s), -1); !reflect.DeepEqual(got, wantLocs) {
+				t.Fatalf("%s: FindAllSubmatchIndex(%q) = %v; want %v", expr, s, got, wantLocs)
+			}
+			if got := re.Match([]byte(s)); got != want.MatchString(text) {
+				t.Fatalf("%s: Match(%q) = %v", expr, s, got)
+			}
+		}
+	}
+}
+
+func TestCompiler(t *testing.T) {
+	c1, err := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CacheSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{})
+
+	re1 := c1.MustCompile(tinyrebuilder.New().Literal("hello"))
+	if c1.MustCompile(tinyrebuilder.New().Literal("hello")) != re1 {
+		t.Error("Expected the Compiler to return its cached Regexp")
+	}
+	if c2.MustCompile(tinyrebuilder.New().Literal("hello")) == re1 {
+		t.Error("Expected Compilers not to share a cache")
+	}
+	if tinyrebuilder.New().Literal("hello").MustCompileWithCache() == re1 {
+		t.Error("Expected the package cache to be separate from the Compiler's")
+	}
+	c1.MustCompile(tinyrebuilder.New().Literal("a"))
+	c1.MustCompile(tinyrebuilder.New().Literal("b"))
+	if c1.Len() != 2 || c1.MustCompile(tinyrebuilder.New().Literal("hello")) == re1 {
+		t.Errorf("Expected hello to be evicted from a cache of two; Len() = %d", c1.Len())
+	}
+	if _, err := c1.Compile(tinyrebuilder.New().Raw("(")); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+
+	strict, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{Policy: &tinyrebuilder.DefaultUntrustedPolicy})
+	var policyErr *tinyrebuilder.PolicyError
+	if _, err := strict.Compile(tinyrebuilder.New().Raw(`.*x`)); !errors.As(err, &policyErr) {
+		t.Errorf("Compile(.*x) error = %v; want a PolicyError", err)
+	}
+	if re, err := strict.Compile(tinyrebuilder.New().Literal("x").OneOrMore()); err != nil || !re.MatchString("xx") {
+		t.Errorf("Compile(x+) = %v, %v", re, err)
+	}
+
+	uncached, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CacheSize: -1})
+	if uncached.MustCompile(tinyrebuilder.New().Literal("a")) == uncached.MustCompile(tinyrebuilder.New().Literal("a")) || uncached.Len() != 0 {
+		t.Error("Expected a Compiler with a negative cache size not to cache")
+	}
+	if err := c1.SetCacheSize(0); err == nil {
+		t.Error("Expected an error for a zero cache size")
+	}
+}
+
+func TestSetCacheSizeConcurrent(t *testing.T) {
+	defer tinyrebuilder.SetCacheSize(128)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := tinyrebuilder.SetCacheSize(1 + i%8); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		p := fmt.Sprintf("p%d", i%16)
+		if re := tinyrebuilder.New().Literal(p).MustCompileWithCache(); !re.MatchString(p) {
+			t.Fatalf("Cached pattern %q does not match itself", p)
+		}
+	}
+	<-done
+}
+
+func TestCompileWithCache(t *testing.T) {
+	tinyrebuilder.PurgeCache()
+	tinyrebuilder.PurgeErrorCache()
+	defer tinyrebuilder.PurgeCache()
+	defer tinyrebuilder.PurgeErrorCache()
+
+	re1, err := tinyrebuilder.New().Literal("user").CompileWithCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re2, err := tinyrebuilder.New().Literal("user").CompileWithCache(); err != nil || re2 != re1 {
+		t.Errorf("CompileWithCache = %p, %v; want the cached %p", re2, err, re1)
+	}
+
+	_, err1 := tinyrebuilder.New().Raw("a(b").CompileWithCache()
+	_, err2 := tinyrebuilder.New().Raw("a(b").CompileWithCache()
+	if err1 == nil || err1 != err2 {
+		t.Errorf("Expected the cached error to be returned again; got %v and %v", err1, err2)
+	}
+	if errs := tinyrebuilder.CachedCompileErrors(); len(errs) != 1 || errs["a(b"] != err1 {
+		t.Errorf("CachedCompileErrors() = %v", errs)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected MustCompileWithCache to panic on a cached failure")
+			}
+		}()
+		tinyrebuilder.New().Raw("a(b").MustCompileWithCache()
+	}()
+
+	tinyrebuilder.PurgeErrorCache()
+	if errs := tinyrebuilder.CachedCompileErrors(); len(errs) != 0 {
+		t.Errorf("CachedCompileErrors() after purge = %v", errs)
+	}
+	if _, err3 := tinyrebuilder.New().Raw("a(b").CompileWithCache(); err3 == nil || err3 == err1 {
+		t.Errorf("Expected a fresh error after purging; got %v", err3)
+	}
+
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{ErrorCacheSize: 2})
+	for _, p := range []string{"(", "[", "*"} {
+		c.Compile(tinyrebuilder.New().Raw(p))
+	}
+	if errs := c.CachedErrors(); len(errs) != 2 || errs["("] != nil {
+		t.Errorf("Expected the oldest failure to be evicted from an error cache of two; got %v", errs)
+	}
+	if c.Len() != 0 {
+		t.Errorf("Failures leaked into the pattern cache: Len() = %d", c.Len())
+	}
+	noErrs, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{ErrorCacheSize: -1})
+	noErrs.Compile(tinyrebuilder.New().Raw("("))
+	if errs := noErrs.CachedErrors(); len(errs) != 0 {
+		t.Errorf("Expected no cached errors when the error cache is disabled; got %v", errs)
+	}
+}
+
+func TestCompileWithCacheConcurrent(t *testing.T) {
+	tinyrebuilder.PurgeCache()
+	tinyrebuilder.PurgeErrorCache()
+	defer tinyrebuilder.PurgeCache()
+	defer tinyrebuilder.PurgeErrorCache()
+
+	const goroutines = 64
+	for round := 0; round < 20; round++ {
+		// A long alternation makes the compilation slow enough for the
+		// goroutines to overlap.
+		words := make([]*tinyrebuilder.RegexBuilder, 200)
+		for i := range words {
+			words[i] = tinyrebuilder.New().Literal(fmt.Sprintf("r%dw%d", round, i))
+		}
+		pattern := tinyrebuilder.New().Or(words...).Build()
+		invalid := pattern + "("
+
+		start := make(chan struct{})
+		results := make([]*tinyrebuilder.Regexp, goroutines)
+		errs := make([]error, goroutines)
+		done := make(chan struct{})
+		for g := 0; g < goroutines; g++ {
+			go func(g int) {
+				defer func() { done <- struct{}{} }()
+				<-start
+				if g%2 == 0 {
+					results[g] = tinyrebuilder.New().Raw(pattern).MustCompileWithCache()
+				} else {
+					_, errs[g] = tinyrebuilder.New().Raw(invalid).CompileWithCache()
+				}
+			}(g)
+		}
+		close(start)
+		for g := 0; g < goroutines; g++ {
+			<-done
+		}
+		for g := 2; g < goroutines; g += 2 {
+			if results[g] != results[0] {
+				t.Fatalf("Round %d: goroutines 0 and %d received different Regexps", round, g)
+			}
+		}
+		for g := 3; g < goroutines; g += 2 {
+			if errs[g] == nil || errs[g] != errs[1] {
+				t.Fatalf("Round %d: goroutines 1 and %d received different errors: %v and %v", round, g, errs[1], errs[g])
+			}
+		}
+	}
+}
+
+func TestCompileWithOptions(t *testing.T) {
+	inputs := randomInputs(19, 200, []string{"a", "b", "ab", "c", "bcd", "d", "\n", "A", "x"})
+	testCases := []struct {
+		pattern string
+		opts    tinyrebuilder.Options
+		want    func(string) *regexp.Regexp
+	}{
+		{`a|ab`, tinyrebuilder.Options{POSIX: true}, regexp.MustCompilePOSIX},
+		{`(a|ab)(c|bcd)(d*)`, tinyrebuilder.Options{POSIX: true}, regexp.MustCompilePOSIX},
+		{`^b|d$`, tinyrebuilder.Options{POSIX: true}, regexp.MustCompilePOSIX},
+		{`[[:alpha:]]+x*`, tinyrebuilder.Options{POSIX: true}, regexp.MustCompilePOSIX},
+		{`(a|ab)(b*)`, tinyrebuilder.Options{Longest: true}, func(p string) *regexp.Regexp {
+			re := regexp.MustCompile(p)
+			re.Longest()
+			return re
+		}},
+		{`a+?b|abc?`, tinyrebuilder.Options{Longest: true}, func(p string) *regexp.Regexp {
+			re := regexp.MustCompile(p)
+			re.Longest()
+			return re
+		}},
+		{`a|ab|bcd`, tinyrebuilder.Options{NoOptimize: true}, regexp.MustCompile},
+		{`^a.b`, tinyrebuilder.Options{Flags: "ism"}, func(p string) *regexp.Regexp { return regexp.MustCompile(`(?ism)` + p) }},
+		{`a+b*`, tinyrebuilder.Options{Flags: "U"}, func(p string) *regexp.Regexp { return regexp.MustCompile(`(?U)` + p) }},
+	}
+	for _, tc := range testCases {
+		want := tc.want(tc.pattern)
+		re, err := tinyrebuilder.New().Raw(tc.pattern).CompileWithOptions(tc.opts)
+		if err != nil {
+			t.Fatalf("%s %+v: %v", tc.pattern, tc.opts, err)
+		}
+		m := re.NewMatcher()
+		for _, s := range inputs {
+			if got, w := re.FindAllStringSubmatch(s, -1), want.FindAllStringSubmatch(s, -1); !reflect.DeepEqual(got, w) {
+				t.Fatalf("%s %+v: FindAllStringSubmatch(%q) = %q; want %q", tc.pattern, tc.opts, s, got, w)
+			}
+			if got, w := re.FindAllStringIndex(s, -1), want.FindAllStringIndex(s, -1); !reflect.DeepEqual(got, w) {
+				t.Fatalf("%s %+v: FindAllStringIndex(%q) = %v; want %v", tc.pattern, tc.opts, s, got, w)
+			}
+			if got, w := re.FindString(s), want.FindString(s); got != w {
+				t.Fatalf("%s %+v: FindString(%q) = %q; want %q", tc.pattern, tc.opts, s, got, w)
+			}
+			// The context methods and the Matcher run on the machine.
+			if got, _ := re.FindAllStringContext(context.Background(), s, -1); !reflect.DeepEqual(got, want.FindAllString(s, -1)) {
+				t.Fatalf("%s %+v: FindAllStringContext(%q) = %q; want %q", tc.pattern, tc.opts, s, got, want.FindAllString(s, -1))
+			}
+			if got, w := m.FindSubmatchIndex(s), want.FindStringSubmatchIndex(s); !reflect.DeepEqual(got, w) {
+				t.Fatalf("%s %+v: Matcher.FindSubmatchIndex(%q) = %v; want %v", tc.pattern, tc.opts, s, got, w)
+			}
+		}
+	}
+
+	if _, err := tinyrebuilder.New().Raw(`\d`).CompileWithOptions(tinyrebuilder.Options{POSIX: true}); err == nil {
+		t.Error(`Expected \d to be rejected in POSIX syntax`)
+	}
+	if _, err := tinyrebuilder.New().Literal("a").CompileWithOptions(tinyrebuilder.Options{Flags: "x"}); err == nil {
+		t.Error("Expected an unknown flag to be rejected")
+	}
+}
+
+func TestCacheKeysIncludeOptions(t *testing.T) {
+	tinyrebuilder.PurgeCache()
+	tinyrebuilder.PurgeErrorCache()
+	defer tinyrebuilder.PurgeCache()
+	defer tinyrebuilder.PurgeErrorCache()
+
+	compile := func(opts tinyrebuilder.Options) *tinyrebuilder.Regexp {
+		re, err := tinyrebuilder.New().Raw("a|ab").CompileWithCacheOptions(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return re
+	}
+	perl := compile(tinyrebuilder.Options{})
+	posix := compile(tinyrebuilder.Options{POSIX: true})
+	if perl == posix || perl.FindString("ab") != "a" || posix.FindString("ab") != "ab" {
+		t.Errorf("POSIX and Perl compilations share a cache entry: %q, %q", perl.FindString("ab"), posix.FindString("ab"))
+	}
+	if perl != tinyrebuilder.New().Raw("a|ab").MustCompileWithCache() {
+		t.Error("Expected the zero Options to share the entry of MustCompileWithCache")
+	}
+	if compile(tinyrebuilder.Options{POSIX: true, Longest: true}) != posix {
+		t.Error("Expected POSIX with and without Longest to share an entry")
+	}
+	if compile(tinyrebuilder.Options{Flags: "si"}) != compile(tinyrebuilder.Options{Flags: "iss"}) {
+		t.Error("Expected equivalent Flags to share an entry")
+	}
+	if compile(tinyrebuilder.Options{NoOptimize: true}) == perl {
+		t.Error("Expected NoOptimize to have its own entry")
+	}
+
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{})
+	_, err := c.CompileWithOptions(tinyrebuilder.New().Raw(`\d+`), tinyrebuilder.Options{POSIX: true})
+	if err == nil {
+		t.Fatal(`Expected \d+ to fail in POSIX syntax`)
+	}
+	if re, err := c.Compile(tinyrebuilder.New().Raw(`\d+`)); err != nil || !re.MatchString("42") {
+		t.Errorf("A POSIX failure was served for the Perl compilation: %v", err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	var evicted []string
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+		CacheSize: 2,
+		OnEvict: func(pattern string, re *tinyrebuilder.Regexp) {
+			if re.String() != pattern {
+				t.Errorf("OnEvict(%q) received the Regexp for %q", pattern, re.String())
+			}
+			evicted = append(evicted, pattern)
+		},
+	})
+	for _, p := range []string{"a", "b", "a", "c", "(", "("} {
+		c.Compile(tinyrebuilder.New().Raw(p))
+	}
+	st := c.Stats()
+	want := tinyrebuilder.CacheMetrics{Hits: 1, ErrorHits: 1, Misses: 4, Evictions: 1, Compilations: 4, Size: 2, Capacity: 2}
+	if st.CompileTime <= 0 {
+		t.Errorf("CompileTime = %v; want it to be positive", st.CompileTime)
+	}
+	st.CompileTime = 0
+	if st != want {
+		t.Errorf("Stats() = %+v; want %+v", st, want)
+	}
+	if !reflect.DeepEqual(evicted, []string{"b"}) {
+		t.Errorf("OnEvict received %q; want [b]", evicted)
+	}
+
+	c.Purge()
+	if st := c.Stats(); st.Size != 0 || st.Capacity != 2 || st.Evictions != 1 || len(evicted) != 1 {
+		t.Errorf("After Purge: Stats() = %+v, evicted %q; want an empty cache and no new evictions", st, evicted)
+	}
+	c.SetEvictCallback(nil)
+	for _, p := range []string{"x", "y", "z"} {
+		c.Compile(tinyrebuilder.New().Raw(p))
+	}
+	if st := c.Stats(); st.Evictions != 2 || len(evicted) != 1 {
+		t.Errorf("Evictions = %d, evicted %q; want the eviction counted without a callback", st.Evictions, evicted)
+	}
+	if st := (&tinyrebuilder.Compiler{}).Stats(); st != (tinyrebuilder.CacheMetrics{}) {
+		t.Errorf("Stats() of a zero Compiler = %+v", st)
+	}
+}
+
+func TestPackageCacheStats(t *testing.T) {
+	if err := tinyrebuilder.SetCacheSize(1); err != nil {
+		t.Fatal(err)
+	}
+	defer tinyrebuilder.SetCacheSize(128)
+	var evicted []string
+	tinyrebuilder.SetCacheEvictCallback(func(pattern string, _ *tinyrebuilder.Regexp) {
+		evicted = append(evicted, pattern)
+	})
+	defer tinyrebuilder.SetCacheEvictCallback(nil)
+
+	before := tinyrebuilder.CacheStats()
+	tinyrebuilder.New().Literal("stats-a").MustCompileWithCache()
+	tinyrebuilder.New().Literal("stats-a").MustCompileWithCache()
+	tinyrebuilder.New().Literal("stats-b").MustCompileWithCache()
+	after := tinyrebuilder.CacheStats()
+	if after.Hits-before.Hits != 1 || after.Misses-before.Misses != 2 || after.Evictions-before.Evictions != 1 {
+		t.Errorf("CacheStats() went from %+v to %+v", before, after)
+	}
+	if after.Capacity != 1 || after.Size != 1 {
+		t.Errorf("CacheStats() Size = %d, Capacity = %d; want 1 and 1", after.Size, after.Capacity)
+	}
+	if !reflect.DeepEqual(evicted, []string{"stats-a"}) {
+		t.Errorf("Eviction callback received %q", evicted)
+	}
+
+	v := expvar.Get("tinyrebuilder.cache")
+	if v == nil {
+		t.Fatal("Expected the cache statistics to be published through expvar")
+	}
+	var published tinyrebuilder.CacheMetrics
+	if err := json.Unmarshal([]byte(v.String()), &published); err != nil || published.Hits < after.Hits {
+		t.Errorf("expvar tinyrebuilder.cache = %s (%v)", v.String(), err)
+	}
+}
+
+// mapCache is a Cache without eviction, for testing custom backends.
+type mapCache struct {
+	mu      sync.Mutex
+	entries map[tinyrebuilder.CacheKey]*tinyrebuilder.Regexp
+}
+
+func (c *mapCache) Get(key tinyrebuilder.CacheKey) (*tinyrebuilder.Regexp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	re, ok := c.entries[key]
+	return re, ok
+}
+
+func (c *mapCache) Add(key tinyrebuilder.CacheKey, re *tinyrebuilder.Regexp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = re
+}
+
+func (c *mapCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// panicCache is a Cache whose Add panics once released, for testing how a
+// failed compilation reaches the goroutines waiting on it.
+type panicCache struct {
+	mapCache
+	release chan struct{}
+}
+
+func (c *panicCache) Add(tinyrebuilder.CacheKey, *tinyrebuilder.Regexp) {
+	<-c.release
+	panic("cache is broken")
+}
+
+func TestCompileWithCachePanic(t *testing.T) {
+	pc := &panicCache{mapCache: mapCache{entries: make(map[tinyrebuilder.CacheKey]*tinyrebuilder.Regexp)}, release: make(chan struct{})}
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+		Backend: func(int, func(tinyrebuilder.CacheKey, *tinyrebuilder.Regexp)) (tinyrebuilder.Cache, error) {
+			return pc, nil
+		},
+	})
+	// One goroutine compiles, and the others wait for it.
+	const callers = 5
+	type result struct {
+		re        *tinyrebuilder.Regexp
+		err       error
+		recovered any
+	}
+	results := make(chan result, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			var r result
+			defer func() {
+				r.recovered = recover()
+				results <- r
+			}()
+			r.re, r.err = c.Compile(tinyrebuilder.New().Literal("doomed"))
+		}()
+	}
+	// Every caller has missed the cache, so the waiters are queued on the
+	// compilation.
+	for c.Stats().Misses < callers {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(pc.release)
+
+	panics := 0
+	for i := 0; i < callers; i++ {
+		r := <-results
+		switch {
+		case r.recovered != nil:
+			if r.recovered != "cache is broken" {
+				t.Errorf("Recovered %v; want the panic of the cache", r.recovered)
+			}
+			panics++
+		case r.err == nil || !strings.Contains(r.err.Error(), "panicked") || r.re != nil:
+			t.Errorf("Waiter got %v, %v; want a panic error", r.re, r.err)
+		}
+	}
+	if panics != 1 {
+		t.Errorf("%d callers panicked; want only the one compiling", panics)
+	}
+}
+
+func TestCacheBackends(t *testing.T) {
+	// A hot pattern used once for every five one-off patterns: LRU forgets
+	// it, while ARC and 2Q keep it once it has been used twice.
+	testCases := []struct {
+		name    string
+		backend tinyrebuilder.CacheFactory
+		hotHits int
+	}{
+		{"LRU", tinyrebuilder.NewLRUCache, 0},
+		{"ARC", tinyrebuilder.NewARCCache, 18},
+		{"2Q", tinyrebuilder.New2QCache, 18},
+		{"Noop", tinyrebuilder.NewNoopCache, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			evicted := 0
+			c, err := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+				CacheSize: 4,
+				Backend:   tc.backend,
+				OnEvict: func(string, *tinyrebuilder.Regexp) {
+					evicted++
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			hotHits := 0
+			for i := 0; i < 20; i++ {
+				before := c.Stats().Hits
+				if !c.MustCompile(tinyrebuilder.New().Literal("hot")).MatchString("hot") {
+					t.Fatal("Cached hot pattern does not match")
+				}
+				if c.Stats().Hits > before {
+					hotHits++
+				}
+				for j := 0; j < 5; j++ {
+					c.MustCompile(tinyrebuilder.New().Literal(fmt.Sprintf("once-%d-%d", i, j)))
+				}
+			}
+			if hotHits != tc.hotHits {
+				t.Errorf("Hot pattern hits = %d; want %d", hotHits, tc.hotHits)
+			}
+			st := c.Stats()
+			if st.Size > 4 {
+				t.Errorf("Size = %d; want at most 4", st.Size)
+			}
+			if int(st.Evictions) != evicted {
+				t.Errorf("Evictions = %d; want the %d reported to OnEvict", st.Evictions, evicted)
+			}
+			if tc.name == "Noop" {
+				if st.Size != 0 || st.Evictions != 0 {
+					t.Errorf("The no-op cache stored patterns: %+v", st)
+				}
+			} else if st.Size+evicted != int(st.Compilations) {
+				t.Errorf("Stats() = %+v; want every compiled pattern cached or evicted", st)
+			}
+		})
+	}
+
+	custom := &mapCache{entries: map[tinyrebuilder.CacheKey]*tinyrebuilder.Regexp{}}
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+		Backend: func(int, func(tinyrebuilder.CacheKey, *tinyrebuilder.Regexp)) (tinyrebuilder.Cache, error) {
+			return custom, nil
+		},
+	})
+	re := c.MustCompile(tinyrebuilder.New().Literal("custom"))
+	posix, _ := c.CompileWithOptions(tinyrebuilder.New().Literal("custom"), tinyrebuilder.Options{POSIX: true})
+	if custom.entries[tinyrebuilder.CacheKey{Pattern: "custom"}] != re || custom.Len() != 2 || posix == re {
+		t.Errorf("Custom cache entries = %v", custom.entries)
+	}
+	if c.MustCompile(tinyrebuilder.New().Literal("custom")) != re {
+		t.Error("Expected the custom cache to serve the second compilation")
+	}
+
+	if err := c.SetCacheBackend(tinyrebuilder.NewARCCache); err != nil || c.Len() != 0 || c.Stats().Capacity != 128 {
+		t.Errorf("SetCacheBackend: %v, Len() = %d, Capacity = %d", err, c.Len(), c.Stats().Capacity)
+	}
+	if err := c.SetCacheBackend(nil); err == nil {
+		t.Error("Expected an error for a nil backend")
+	}
+	if err := tinyrebuilder.SetCacheBackend(tinyrebuilder.New2QCache); err != nil {
+		t.Fatal(err)
+	}
+	defer tinyrebuilder.SetCacheBackend(tinyrebuilder.NewLRUCache)
+	if re := tinyrebuilder.New().Literal("2q").MustCompileWithCache(); re != tinyrebuilder.New().Literal("2q").MustCompileWithCache() {
+		t.Error("Expected the 2Q package cache to serve the second compilation")
+	}
+}
+
+func TestCostCache(t *testing.T) {
+	words := make([]*tinyrebuilder.RegexBuilder, 5000)
+	for i := range words {
+		words[i] = tinyrebuilder.New().Literal(fmt.Sprintf("keyword%d", i))
+	}
+	huge := tinyrebuilder.New().Or(words...).MustCompile()
+	tiny := tinyrebuilder.New().Digit().OneOrMore().MustCompile()
+	if huge.Cost() < 100*tiny.Cost() {
+		t.Fatalf("Cost() of 5000 keywords = %d, of \\d+ = %d; want the alternation to weigh far more", huge.Cost(), tiny.Cost())
+	}
+
+	var evicted []string
+	budget := 10 * tiny.Cost()
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+		Backend: tinyrebuilder.NewCostCache(budget, 0),
+		OnEvict: func(pattern string, _ *tinyrebuilder.Regexp) { evicted = append(evicted, pattern) },
+	})
+	for i := 0; i < 20; i++ {
+		c.MustCompile(tinyrebuilder.New().Literal(fmt.Sprintf("%d", i)))
+	}
+	st := c.Stats()
+	if st.Bytes > budget || st.Size == 0 || st.Size >= 20 || int(st.Evictions) != 20-st.Size {
+		t.Errorf("Stats() = %+v with a budget of %d bytes", st, budget)
+	}
+	if len(evicted) == 0 || evicted[0] != "0" {
+		t.Errorf("Evicted %q; want the least recently used patterns first", evicted)
+	}
+	// A pattern larger than the budget is compiled but not cached.
+	bigPattern := huge.String()
+	if c.MustCompile(tinyrebuilder.New().Raw(bigPattern)) == c.MustCompile(tinyrebuilder.New().Raw(bigPattern)) {
+		t.Error("Expected a pattern over the budget not to be cached")
+	}
+	if after := c.Stats(); after.Bytes > budget || after.Size != st.Size {
+		t.Errorf("Stats() after the oversized pattern = %+v", after)
+	}
+
+	// Only the entry count limits the cache when the budget is generous.
+	counted, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CacheSize: 3, Backend: tinyrebuilder.NewCostCache(1<<30, 0)})
+	for i := 0; i < 5; i++ {
+		counted.MustCompile(tinyrebuilder.New().Literal(fmt.Sprintf("%d", i)))
+	}
+	if st := counted.Stats(); st.Size != 3 || st.Evictions != 2 {
+		t.Errorf("Stats() = %+v; want 3 entries after 2 evictions", st)
+	}
+
+	evicted = nil
+	ttl := 100 * time.Millisecond
+	expiring, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+		Backend: tinyrebuilder.NewCostCache(1<<30, ttl),
+		OnEvict: func(pattern string, _ *tinyrebuilder.Regexp) { evicted = append(evicted, pattern) },
+	})
+	idle := expiring.MustCompile(tinyrebuilder.New().Literal("idle"))
+	busy := expiring.MustCompile(tinyrebuilder.New().Literal("busy"))
+	for i := 0; i < 6; i++ {
+		time.Sleep(ttl / 4)
+		if expiring.MustCompile(tinyrebuilder.New().Literal("busy")) != busy {
+			t.Fatal("Expected a pattern in use not to expire")
+		}
+	}
+	if expiring.MustCompile(tinyrebuilder.New().Literal("idle")) == idle {
+		t.Error("Expected an idle pattern to expire")
+	}
+	if !reflect.DeepEqual(evicted, []string{"idle"}) {
+		t.Errorf("Expired %q; want [idle]", evicted)
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	evicted := 0
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+		CacheSize: 64,
+		Backend:   tinyrebuilder.NewShardedCache(8),
+		OnEvict:   func(string, *tinyrebuilder.Regexp) { evicted++ },
+	})
+	hot := c.MustCompile(tinyrebuilder.New().Literal("hot"))
+	for i := 0; i < 500; i++ {
+		c.MustCompile(tinyrebuilder.New().Literal(fmt.Sprintf("once-%d", i)))
+		// A pattern in constant use keeps getting a second chance.
+		if c.MustCompile(tinyrebuilder.New().Literal("hot")) != hot {
+			t.Fatalf("Hot pattern evicted after %d one-off patterns", i+1)
+		}
+	}
+	st := c.Stats()
+	if st.Size > 64 || st.Size < 32 || int(st.Evictions) != evicted || st.Size+evicted != int(st.Compilations) {
+		t.Errorf("Stats() = %+v with %d evictions reported", st, evicted)
+	}
+
+	if _, err := tinyrebuilder.NewShardedCache(4)(0, nil); err == nil {
+		t.Error("NewShardedCache accepted a cache size of 0")
+	}
+
+	tiny, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CacheSize: 3, Backend: tinyrebuilder.NewShardedCache(16)})
+	for i := 0; i < 10; i++ {
+		tiny.MustCompile(tinyrebuilder.New().Literal(fmt.Sprintf("%d", i)))
+	}
+	if st := tiny.Stats(); st.Size > 3 || st.Size == 0 {
+		t.Errorf("Stats() with more shards than entries = %+v", st)
+	}
+
+	// Concurrent compilations of overlapping patterns all agree.
+	shared, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CacheSize: 1024, Backend: tinyrebuilder.NewShardedCache(0)})
+	var wg sync.WaitGroup
+	results := make([][]*tinyrebuilder.Regexp, 8)
+	for g := range results {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				results[g] = append(results[g], shared.MustCompile(tinyrebuilder.New().Literal(fmt.Sprintf("p%d", i))))
+			}
+		}(g)
+	}
+	wg.Wait()
+	for g := 1; g < len(results); g++ {
+		for i := range results[g] {
+			if results[g][i] != results[0][i] {
+				t.Fatalf("Goroutines 0 and %d received different Regexps for p%d", g, i)
+			}
+		}
+	}
+}
+
+func TestCacheManifest(t *testing.T) {
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CacheSize: 8})
+	c.MustCompile(tinyrebuilder.New().Literal("a"))
+	c.MustCompile(tinyrebuilder.New().Literal("b"))
+	if _, err := c.CompileWithOptions(tinyrebuilder.New().Literal("c"), tinyrebuilder.Options{Flags: "si"}); err != nil {
+		t.Fatal(err)
+	}
+	c.MustCompile(tinyrebuilder.New().Literal("a"))
+
+	var dump bytes.Buffer
+	if err := c.DumpManifest(&dump); err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]any
+	if err := json.Unmarshal(dump.Bytes(), &entries); err != nil {
+		t.Fatalf("DumpManifest wrote invalid JSON %q: %v", dump.String(), err)
+	}
+	want := []map[string]any{{"pattern": "a"}, {"pattern": "c", "flags": "is"}, {"pattern": "b"}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("DumpManifest() = %v, want %v", entries, want)
+	}
+
+	// Warming a new Compiler reproduces the cache, in the same order.
+	warm, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CacheSize: 8})
+	if err := warm.Warm(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := warm.DumpManifest(&again); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != dump.String() {
+		t.Errorf("DumpManifest() after Warm = %s, want %s", again.String(), dump.String())
+	}
+	if st := warm.Stats(); st.Compilations != 3 {
+		t.Errorf("Warm compiled %d patterns, want 3", st.Compilations)
+	}
+	warm.MustCompile(tinyrebuilder.New().Literal("b"))
+	if st := warm.Stats(); st.Hits != 1 || st.Compilations != 3 {
+		t.Errorf("Stats() after warming = %+v, want a hit", st)
+	}
+
+	// Plain text manifests and JSON lists of strings are accepted, and
+	// failures name their entries without stopping the others.
+	manifests := []struct {
+		name, manifest string
+		size           int
+		bad            string
+	}{
+		{"Lines", "[a-z]+\n\nfoo\r\n(\n", 2, "manifest entry 3"},
+		{"Strings", `["x", {"pattern": "y", "flags": "q"}, {"pattern": "z", "posix": true}]`, 2, "manifest entry 2"},
+	}
+	for _, tc := range manifests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{})
+			err := c.Warm(strings.NewReader(tc.manifest))
+			if err == nil || !strings.Contains(err.Error(), tc.bad) {
+				t.Errorf("Warm() error = %v, want one for %s", err, tc.bad)
+			}
+			if c.Len() != tc.size {
+				t.Errorf("Len() after Warm = %d, want %d", c.Len(), tc.size)
+			}
+		})
+	}
+
+	// With canonical keys, the order of the manifest is kept under the
+	// canonical forms.
+	canon, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CanonicalKeys: true})
+	if err := canon.Warm(strings.NewReader("a|b\nx\n(?:d|c)\n")); err != nil {
+		t.Fatal(err)
+	}
+	var canonDump bytes.Buffer
+	if err := canon.DumpManifest(&canonDump); err != nil {
+		t.Fatal(err)
+	}
+	entries = nil
+	if err := json.Unmarshal(canonDump.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	want = []map[string]any{{"pattern": "[ab]"}, {"pattern": "x"}, {"pattern": "[cd]"}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("DumpManifest() after Warm with canonical keys = %v, want %v", entries, want)
+	}
+
+	small, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CacheSize: 2})
+	if err := small.Warm(strings.NewReader("p1\np2\np3\np4\n")); err != nil {
+		t.Fatal(err)
+	}
+	if st := small.Stats(); st.Compilations != 2 || st.Evictions != 0 {
+		t.Errorf("Warm of a small cache: Stats() = %+v, want only the first 2 compiled", st)
+	}
+
+	for _, backend := range []tinyrebuilder.CacheFactory{
+		tinyrebuilder.NewARCCache, tinyrebuilder.New2QCache,
+		tinyrebuilder.NewCostCache(1<<20, 0), tinyrebuilder.NewShardedCache(4),
+	} {
+		c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{Backend: backend})
+		if err := c.Warm(strings.NewReader("a\nb\nc\n")); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := c.DumpManifest(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var got []map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil || len(got) != 3 {
+			t.Errorf("DumpManifest() = %s, %v, want 3 entries", buf.String(), err)
+		}
+	}
+
+	custom, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+		Backend: func(int, func(tinyrebuilder.CacheKey, *tinyrebuilder.Regexp)) (tinyrebuilder.Cache, error) {
+			return &mapCache{entries: make(map[tinyrebuilder.CacheKey]*tinyrebuilder.Regexp)}, nil
+		},
+	})
+	if err := custom.DumpManifest(io.Discard); err == nil {
+		t.Error("DumpManifest() of a cache that cannot list its keys succeeded")
+	}
+
+	if err := tinyrebuilder.WarmCache(strings.NewReader("package-level-warm")); err != nil {
+		t.Fatal(err)
+	}
+	var pkg bytes.Buffer
+	if err := tinyrebuilder.DumpCacheManifest(&pkg); err != nil || !strings.Contains(pkg.String(), `"package-level-warm"`) {
+		t.Errorf("DumpCacheManifest() = %s, %v", pkg.String(), err)
+	}
+}
+
+func TestCanonicalKeys(t *testing.T) {
+	c, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{CanonicalKeys: true})
+	first := c.MustCompile(tinyrebuilder.New().Raw("a|b"))
+	for _, p := range []string{"[ab]", "(?:b|a)", "[a-b]"} {
+		if re := c.MustCompile(tinyrebuilder.New().Raw(p)); re != first {
+			t.Errorf("%q and a|b were cached separately", p)
+		}
+	}
+	// Flags in the options and in the pattern amount to the same thing.
+	folded, err := c.CompileWithOptions(tinyrebuilder.New().Raw("x"), tinyrebuilder.Options{Flags: "i"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re := c.MustCompile(tinyrebuilder.New().Raw("[Xx]")); re != folded {
+		t.Error("(?i)x and [Xx] were cached separately")
+	}
+	if st := c.Stats(); st.Size != 2 || st.Compilations != 2 || st.Hits != 4 {
+		t.Errorf("Stats() = %+v, want 2 entries and 4 hits", st)
+	}
+
+	// Canonical forms keep the capture groups and the matches of the
+	// patterns they stand for.
+	for _, p := range []string{`(a){3}`, `(?P<year>\d{4})-(\d{2})`, `x{2,5}|y`, `^a$`, `(?m)^a$`, `(?U)a+`, `(?s)a.b`, `\bfoo\b`} {
+		re := c.MustCompile(tinyrebuilder.New().Raw(p))
+		std := regexp.MustCompile(p)
+		if !reflect.DeepEqual(re.SubexpNames(), std.SubexpNames()) {
+			t.Errorf("%q: SubexpNames() = %q, want %q", p, re.SubexpNames(), std.SubexpNames())
+		}
+		for _, s := range []string{"aaa", "2024-05", "xxxxx y", "a", "b\na\nc", "aaaa", "a\nb", "foo bar"} {
+			if got, want := re.FindAllStringSubmatch(s, -1), std.FindAllStringSubmatch(s, -1); !reflect.DeepEqual(got, want) {
+				t.Errorf("%q on %q: got %q, want %q", p, s, got, want)
+			}
+			if got, want := re.FindAllStringIndex(s, -1), std.FindAllStringIndex(s, -1); !reflect.DeepEqual(got, want) {
+				t.Errorf("%q on %q: got indices %v, want %v", p, s, got, want)
+			}
+		}
+	}
+	if _, err := c.Compile(tinyrebuilder.New().Raw("a(")); err == nil {
+		t.Error("Compile of an invalid pattern succeeded")
+	}
+
+	// The policy sees patterns as written, before canonicalization.
+	strict, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{
+		CanonicalKeys: true,
+		Policy:        &tinyrebuilder.CompilePolicy{MaxRepeat: 3},
+	})
+	strict.MustCompile(tinyrebuilder.New().Raw("aaaa"))
+	var perr *tinyrebuilder.PolicyError
+	if _, err := strict.Compile(tinyrebuilder.New().Raw("a{4}")); !errors.As(err, &perr) {
+		t.Errorf("Compile(a{4}) error = %v, want a PolicyError", err)
+	}
+
+	plain, _ := tinyrebuilder.NewCompiler(tinyrebuilder.CompilerOptions{})
+	plain.MustCompile(tinyrebuilder.New().Raw("a|b"))
+	plain.MustCompile(tinyrebuilder.New().Raw("[ab]"))
+	plain.SetCanonicalKeys(true)
+	// [ab] is its own canonical form, so the entry cached for it serves the
+	// other spellings.
+	plain.MustCompile(tinyrebuilder.New().Raw("(?:b|a)"))
+	plain.MustCompile(tinyrebuilder.New().Raw("a|b"))
+	if st := plain.Stats(); st.Size != 2 || st.Hits != 2 {
+		t.Errorf("Stats() after SetCanonicalKeys = %+v, want 2 entries and 2 hits", st)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fp := tinyrebuilder.New().Raw("a|b").Fingerprint()
+	for _, p := range []string{"[ab]", "(?:b|a)"} {
+		if got := tinyrebuilder.New().Raw(p).Fingerprint(); got != fp {
+			t.Errorf("Fingerprint of %q = %x, want %x as for a|b", p, got, fp)
+		}
+	}
+	for _, p := range []string{"a|c", "(a|b)", "ab", "a(", "a{2}(", "a{2}"} {
+		if got := tinyrebuilder.New().Raw(p).Fingerprint(); got == fp {
+			t.Errorf("Fingerprint of %q equals that of a|b", p)
+		}
+	}
+	if a, b := tinyrebuilder.New().Raw("a(").Fingerprint(), tinyrebuilder.New().Raw("a(").Fingerprint(); a != b {
+		t.Errorf("Fingerprint of an invalid pattern varies: %x, %x", a, b)
+	}
+
+	b := tinyrebuilder.New().Literal("user").Digit().OneOrMore().Literal("@").Raw(`\w+|\pL`)
+	want := b.Fingerprint()
+	re := b.MustCompile()
+	if re.Fingerprint() != want {
+		t.Errorf("Regexp.Fingerprint() = %x, want %x as for its builder", re.Fingerprint(), want)
+	}
+	longest, err := tinyrebuilder.New().Raw("a|b").CompileWithOptions(tinyrebuilder.Options{Longest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longest.Fingerprint() == fp {
+		t.Error("Fingerprint ignores leftmost-longest matching")
+	}
+	posix, err := tinyrebuilder.New().Raw("[ab]").CompileWithOptions(tinyrebuilder.Options{POSIX: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posix.Fingerprint() != longest.Fingerprint() {
+		t.Errorf("POSIX [ab] Fingerprint = %x, want %x as for leftmost-longest a|b", posix.Fingerprint(), longest.Fingerprint())
+	}
+}
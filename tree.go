@@ -0,0 +1,401 @@
+package tinyrebuilder
+
+import (
+	"regexp/syntax"
+	"sync"
+)
+
+// Match is a node of a MatchTree. Each node is the capture of one group, and
+// its children are the captures of the groups nested directly inside it.
+type Match struct {
+	// Name is the name of the group, or empty for unnamed groups and the root.
+	Name string
+	// Index is the number of the group, or 0 for the root.
+	Index int
+	// Start and End are the byte offsets of the capture in the input.
+	Start, End int
+	// Text is the captured text.
+	Text string
+	// Children holds the captures of the groups nested inside this one, in the
+	// order they occur in the input. A group under a repetition appears once
+	// per iteration.
+	Children []Match
+}
+
+// Repeated returns every capture of the named group within m, in the order
+// they occur in the input. Unlike FindStringSubmatch, which only keeps the
+// last iteration of a repeated group, it returns one Match per iteration.
+func (m *Match) Repeated(name string) []Match {
+	var out []Match
+	for i := range m.Children {
+		c := &m.Children[i]
+		if c.Name == name {
+			out = append(out, *c)
+		}
+		out = append(out, c.Repeated(name)...)
+	}
+	return out
+}
+
+// Lookup follows a path of group names down the tree, each step descending to
+// the first capture of the named group nested inside the previous one. For
+// example, Lookup("authority", "host") returns the host captured inside the
+// authority. It reports false if a step has no such capture.
+func (m *Match) Lookup(path ...string) (Match, bool) {
+	cur := m
+	for _, name := range path {
+		next := cur.find(name)
+		if next == nil {
+			return Match{}, false
+		}
+		cur = next
+	}
+	return *cur, true
+}
+
+// find returns the first capture of the named group nested inside m.
+func (m *Match) find(name string) *Match {
+	for i := range m.Children {
+		c := &m.Children[i]
+		if c.Name == name {
+			return c
+		}
+		if found := c.find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for m and every capture nested inside it, parents before
+// children, with the depth of each node below m. Returning false from fn skips
+// the children of that node.
+func (m *Match) Walk(fn func(m *Match, depth int) bool) {
+	m.walk(fn, 0)
+}
+
+func (m *Match) walk(fn func(m *Match, depth int) bool, depth int) {
+	if !fn(m, depth) {
+		return
+	}
+	for i := range m.Children {
+		m.Children[i].walk(fn, depth+1)
+	}
+}
+
+// MatchTree is a match whose captures are arranged the way the groups are
+// nested in the pattern, so that a capture inside another is found by a tree
+// lookup rather than index arithmetic. Its root is the whole match.
+type MatchTree struct {
+	Match
+}
+
+// FindMatchTree returns the leftmost match of the Regexp in s as a MatchTree,
+// or nil if there is no match. Groups under a repetition such as
+// Group(x).OneOrMore() are reported once per iteration: the matched span of
+// the repeated region is re-scanned with the repeated sub-pattern to recover
+// the captures of every iteration.
+func (r *Regexp) FindMatchTree(s string) *MatchTree {
+	if !r.prefilter().mayMatch(s) {
+		return nil
+	}
+	t := r.treeProgram()
+	m := newMachine(t.prog)
+	if !m.match(s, 0, false) {
+		return nil
+	}
+	tree := &MatchTree{Match{Start: m.matchcap[0], End: m.matchcap[1], Text: s[m.matchcap[0]:m.matchcap[1]]}}
+	t.expand(s, m.matchcap, t.nodes, &tree.Match)
+	return tree
+}
+
+// treeProgram returns the match tree program of r, compiling it on first use.
+func (r *Regexp) treeProgram() *treeProgram {
+	r.vm.treeOnce.Do(func() {
+		tree, err := parseMachineExpr(r.String())
+		if err == nil {
+			r.vm.tree, err = newTreeProgram(tree, r.re.SubexpNames(), r.longest)
+		}
+		if err != nil {
+			// The pattern was already accepted by regexp.Compile.
+			panic(err)
+		}
+	})
+	return r.vm.tree
+}
+
+// treeProgram runs an expression in which every repetition containing groups
+// is wrapped in an extra capture, so that the span of each repeated region is
+// known and can be re-scanned iteration by iteration.
+type treeProgram struct {
+	prog    *program
+	names   []string
+	nodes   []*treeNode
+	iterCap int
+	longest bool
+}
+
+// treeNode is a group or a repeated region in the static structure of the
+// expression.
+type treeNode struct {
+	group    int
+	region   *treeRegion
+	children []*treeNode
+}
+
+// treeRegion is a repetition containing groups.
+type treeRegion struct {
+	cap  int
+	rep  *syntax.Regexp
+	body *syntax.Regexp
+
+	mu    sync.Mutex
+	progs map[int]*program
+	// once matches a single iteration on its own.
+	once *program
+}
+
+func newTreeProgram(re *syntax.Regexp, names []string, longest bool) (*treeProgram, error) {
+	t := &treeProgram{names: names, longest: longest}
+	next := len(names)
+	var regions []*treeRegion
+	re = wrapRegions(re, &next, &regions)
+	t.iterCap = next
+	prog, err := newProgram(re)
+	if err != nil {
+		return nil, err
+	}
+	prog.longest = longest
+	t.prog = prog
+	byCap := make(map[int]*treeRegion, len(regions))
+	for _, rg := range regions {
+		byCap[rg.cap] = rg
+	}
+	t.nodes = buildTreeNodes(re, byCap)
+	return t, nil
+}
+
+// wrapRegions returns re with every repetition that contains a capture wrapped
+// in a new capture numbered from *next onwards.
+func wrapRegions(re *syntax.Regexp, next *int, regions *[]*treeRegion) *syntax.Regexp {
+	if !hasCapture(re) {
+		return re
+	}
+	cp := *re
+	cp.Sub = make([]*syntax.Regexp, len(re.Sub))
+	for i, sub := range re.Sub {
+		cp.Sub[i] = wrapRegions(sub, next, regions)
+	}
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat:
+		rg := &treeRegion{cap: *next, rep: &cp, body: cp.Sub[0], progs: make(map[int]*program)}
+		*next++
+		*regions = append(*regions, rg)
+		return &syntax.Regexp{Op: syntax.OpCapture, Cap: rg.cap, Sub: []*syntax.Regexp{&cp}}
+	}
+	return &cp
+}
+
+// hasCapture reports whether re contains a capturing group. Unicode word
+// boundary markers are assertions, not groups.
+func hasCapture(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpCapture && re.Cap < markerCapBase {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasCapture(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripCaptures returns a copy of re without any capturing groups.
+func stripCaptures(re *syntax.Regexp) *syntax.Regexp {
+	if re.Op == syntax.OpCapture && re.Cap < markerCapBase {
+		return stripCaptures(re.Sub[0])
+	}
+	if !hasCapture(re) {
+		return re
+	}
+	cp := *re
+	cp.Sub = make([]*syntax.Regexp, len(re.Sub))
+	for i, sub := range re.Sub {
+		cp.Sub[i] = stripCaptures(sub)
+	}
+	return &cp
+}
+
+// buildTreeNodes returns the outermost groups and regions in re.
+func buildTreeNodes(re *syntax.Regexp, regions map[int]*treeRegion) []*treeNode {
+	if re.Op != syntax.OpCapture || re.Cap >= markerCapBase {
+		var nodes []*treeNode
+		for _, sub := range re.Sub {
+			nodes = append(nodes, buildTreeNodes(sub, regions)...)
+		}
+		return nodes
+	}
+	n := &treeNode{group: re.Cap}
+	if rg, ok := regions[re.Cap]; ok {
+		n.group, n.region = 0, rg
+	}
+	n.children = buildTreeNodes(re.Sub[0], regions)
+	return []*treeNode{n}
+}
+
+// expand adds the captures recorded in caps for nodes to parent, re-scanning
+// repeated regions.
+func (t *treeProgram) expand(s string, caps []int, nodes []*treeNode, parent *Match) {
+	for _, n := range nodes {
+		if n.region != nil {
+			if start := caps[2*n.region.cap]; start >= 0 {
+				t.iterate(s, n.region, start, caps[2*n.region.cap+1], n.children, parent)
+			}
+			continue
+		}
+		start, end := caps[2*n.group], caps[2*n.group+1]
+		if start < 0 {
+			continue
+		}
+		m := Match{Name: t.names[n.group], Index: n.group, Start: start, End: end, Text: s[start:end]}
+		t.expand(s, caps, n.children, &m)
+		parent.Children = append(parent.Children, m)
+	}
+}
+
+// iterate re-scans the span [start, end) matched by a repeated region one
+// iteration at a time, adding the captures of each iteration to parent.
+func (t *treeProgram) iterate(s string, rg *treeRegion, start, end int, nodes []*treeNode, parent *Match) {
+	if caps, n, ok := t.split(s, rg, start, end); ok {
+		for i := 0; i < len(caps); i += n {
+			t.expand(s, caps[i:i+n], nodes, parent)
+		}
+		return
+	}
+	var m *machine
+	for k, pos := 0, start; pos < end || k < rg.minIterations(); k++ {
+		p, err := t.iteration(rg, k)
+		if err != nil {
+			return
+		}
+		if m == nil || m.p != p {
+			m = newMachine(p)
+			m.mustEnd = end
+		}
+		if !m.match(s, pos, true) {
+			return
+		}
+		t.expand(s, m.matchcap, nodes, parent)
+		next := m.matchcap[2*t.iterCap+1]
+		if next == pos {
+			return
+		}
+		pos = next
+	}
+}
+
+// split divides the span [start, end) of a repeated region into iterations by
+// matching one iteration at a time on its own, which scans the span once,
+// and returns the submatch indices of the iterations, n to each. It reports
+// false if the iterations so found do not fill the span within the bounds of
+// the repetition, in which case iterate falls back to matching each iteration
+// together with the rest of the span.
+//
+// When they do fill it, each iteration is the one the fallback finds: the
+// choices of an iteration take precedence over those of the iterations after
+// it, and the iterations found show that the rest of the span can follow.
+func (t *treeProgram) split(s string, rg *treeRegion, start, end int) (caps []int, n int, ok bool) {
+	p, err := t.single(rg)
+	if err != nil {
+		return nil, 0, false
+	}
+	m := newMachine(p)
+	n = len(m.matchcap)
+	maxIter := -1
+	if rg.rep.Op == syntax.OpRepeat {
+		maxIter = rg.rep.Max
+	}
+	pos := start
+	for k := 0; pos < end || k < rg.minIterations(); k++ {
+		if maxIter >= 0 && k >= maxIter || !m.match(s, pos, true) {
+			return nil, 0, false
+		}
+		next := m.matchcap[2*t.iterCap+1]
+		if next > end {
+			return nil, 0, false
+		}
+		caps = append(caps, m.matchcap...)
+		if next == pos {
+			break
+		}
+		pos = next
+	}
+	return caps, n, pos == end
+}
+
+// minIterations returns the number of iterations the region always matches.
+func (rg *treeRegion) minIterations() int {
+	switch rg.rep.Op {
+	case syntax.OpPlus:
+		return 1
+	case syntax.OpRepeat:
+		return rg.rep.Min
+	}
+	return 0
+}
+
+// single returns the program that matches one iteration of rg, captured as
+// iterCap, by itself. It prefers leftmost-first matches even when t does not,
+// as the iterations of a span of fixed length are chosen by priority.
+func (t *treeProgram) single(rg *treeRegion) (*program, error) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	if rg.once != nil {
+		return rg.once, nil
+	}
+	p, err := newProgram(&syntax.Regexp{Op: syntax.OpCapture, Cap: t.iterCap, Sub: []*syntax.Regexp{rg.body}})
+	if err != nil {
+		return nil, err
+	}
+	rg.once = p
+	return p, nil
+}
+
+// iteration returns the program that matches one iteration of rg, captured as
+// iterCap, followed by whatever iterations may remain after k have been done.
+// Once k reaches the minimum of an unbounded repetition, the iterations that
+// remain are the same, so k is capped there.
+func (t *treeProgram) iteration(rg *treeRegion, k int) (*program, error) {
+	switch {
+	case rg.rep.Op != syntax.OpRepeat:
+		k = 0
+	case rg.rep.Max < 0:
+		k = min(k, rg.rep.Min)
+	}
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	if p, ok := rg.progs[k]; ok {
+		return p, nil
+	}
+	rest := &syntax.Regexp{Op: syntax.OpStar, Flags: rg.rep.Flags, Sub: []*syntax.Regexp{stripCaptures(rg.body)}}
+	if rg.rep.Op == syntax.OpRepeat {
+		rest.Op, rest.Min, rest.Max = syntax.OpRepeat, max(rg.rep.Min-k-1, 0), rg.rep.Max
+		if rest.Max >= 0 {
+			rest.Max -= k + 1
+		}
+		if rest.Max == 0 {
+			rest = &syntax.Regexp{Op: syntax.OpEmptyMatch}
+		}
+	}
+	re := &syntax.Regexp{Op: syntax.OpConcat, Sub: []*syntax.Regexp{
+		{Op: syntax.OpCapture, Cap: t.iterCap, Sub: []*syntax.Regexp{rg.body}},
+		rest,
+	}}
+	p, err := newProgram(re)
+	if err != nil {
+		return nil, err
+	}
+	p.longest = t.longest
+	rg.progs[k] = p
+	return p, nil
+}